@@ -2,50 +2,214 @@ package main
 
 import (
 	"context"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
-	"log"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"log/slog"
+	"microService/internal/config"
 	"microService/internal/microServerMainFiles"
+	"microService/pkg/email"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
-func setupRoutes() *http.ServeMux {
+func setupRoutes(cfg *config.Config) *http.ServeMux {
 	mux := http.NewServeMux()
-	mux.Handle("/api/cart/add", microServerMainFiles.JWTMiddleware(http.HandlerFunc(microServerMainFiles.AddProductToCart)))
-	mux.Handle("/api/cart", microServerMainFiles.JWTMiddleware(http.HandlerFunc(microServerMainFiles.GetCart)))
-	mux.Handle("/api/cart/clear", microServerMainFiles.JWTMiddleware(http.HandlerFunc(microServerMainFiles.ClearCart)))
-	mux.Handle("/api/transaction/checkout", microServerMainFiles.JWTMiddleware(http.HandlerFunc(microServerMainFiles.Checkout)))
-	mux.Handle("/api/transaction/deleteLast", microServerMainFiles.JWTMiddleware(http.HandlerFunc(microServerMainFiles.DeleteLastTransaction)))
-	mux.Handle("/api/transaction/pay", microServerMainFiles.JWTMiddleware(http.HandlerFunc(microServerMainFiles.ProcessPayment)))
-	mux.Handle("/api/transaction/pending", microServerMainFiles.JWTMiddleware(http.HandlerFunc(microServerMainFiles.GetPendingTransaction)))
-	mux.Handle("/api/transactions", microServerMainFiles.JWTMiddleware(http.HandlerFunc(microServerMainFiles.GetTransactions)))
-	mux.HandleFunc("/signup", microServerMainFiles.SignUp)
-	mux.HandleFunc("/login", microServerMainFiles.Login)
-	mux.Handle("/", http.FileServer(http.Dir("web")))
+	// Every route is instrumented and traced under its own pattern. The
+	// span is started first so request logs carry its trace ID.
+	handle := func(pattern string, handler http.Handler) {
+		mux.Handle(pattern, otelhttp.NewHandler(microServerMainFiles.InstrumentRoute(pattern, microServerMainFiles.RequestIDMiddleware(pattern, handler)), pattern))
+	}
+	handle("/api/cart/add", microServerMainFiles.JWTMiddleware(http.HandlerFunc(microServerMainFiles.AddProductToCart)))
+	handle("/api/cart", microServerMainFiles.JWTMiddleware(http.HandlerFunc(microServerMainFiles.GetCart)))
+	handle("/api/cart/items/", microServerMainFiles.JWTMiddleware(http.HandlerFunc(microServerMainFiles.CartItemByProductID)))
+	handle("/api/cart/clear", microServerMainFiles.JWTMiddleware(http.HandlerFunc(microServerMainFiles.ClearCart)))
+	handle("/api/transaction/checkout", microServerMainFiles.JWTMiddleware(microServerMainFiles.IdempotencyMiddleware(http.HandlerFunc(microServerMainFiles.Checkout))))
+	handle("/api/transaction/pay", microServerMainFiles.JWTMiddleware(microServerMainFiles.IdempotencyMiddleware(http.HandlerFunc(microServerMainFiles.ProcessPayment))))
+	handle("/api/transaction/pending", microServerMainFiles.JWTMiddleware(http.HandlerFunc(microServerMainFiles.GetPendingTransaction)))
+	handle("/api/transactions", microServerMainFiles.JWTMiddleware(http.HandlerFunc(microServerMainFiles.GetTransactions)))
+	handle("/api/transactions/", microServerMainFiles.JWTMiddleware(http.HandlerFunc(microServerMainFiles.TransactionAction)))
+	handle("/api/admin/transactions/", microServerMainFiles.JWTMiddleware(http.HandlerFunc(microServerMainFiles.PurgeTransactionHandler)))
+	handle("/api/account/password", microServerMainFiles.JWTMiddleware(http.HandlerFunc(microServerMainFiles.ChangeAccountPassword)))
+	handle("/api/account/sessions", microServerMainFiles.JWTMiddleware(http.HandlerFunc(microServerMainFiles.AccountSessions)))
+	handle("/api/account/sessions/", microServerMainFiles.JWTMiddleware(http.HandlerFunc(microServerMainFiles.AccountSession)))
+	handle("/api/account/verification", microServerMainFiles.JWTMiddleware(http.HandlerFunc(microServerMainFiles.ResendVerification)))
+	handle("/api/products", microServerMainFiles.JWTMiddleware(http.HandlerFunc(microServerMainFiles.Products)))
+	handle("/api/products/", microServerMainFiles.JWTMiddleware(http.HandlerFunc(microServerMainFiles.ProductByID)))
+	handle("/products", http.HandlerFunc(microServerMainFiles.ListPublicProducts))
+	handle("/signup", http.HandlerFunc(microServerMainFiles.SignUp))
+	handle("/login", http.HandlerFunc(microServerMainFiles.Login))
+	handle("/token/refresh", http.HandlerFunc(microServerMainFiles.RefreshTokenHandler))
+	handle("/logout", http.HandlerFunc(microServerMainFiles.Logout))
+	handle("/password/forgot", http.HandlerFunc(microServerMainFiles.ForgotPassword))
+	handle("/password/reset", http.HandlerFunc(microServerMainFiles.ResetPasswordHandler))
+	handle("/verify", http.HandlerFunc(microServerMainFiles.VerifyEmailHandler))
+	handle("/healthz", http.HandlerFunc(microServerMainFiles.Healthz))
+	handle("/readyz", http.HandlerFunc(microServerMainFiles.Readyz))
+	mux.Handle("/metrics", promhttp.Handler())
+	handle("/", http.FileServer(http.Dir(cfg.Server.StaticDir)))
 	return mux
 }
 
 func main() {
-	client, err := connectToMongoDB()
+	// Configuration problems are logged before the level is known
+	slog.SetDefault(microServerMainFiles.NewLogger(os.Stdout, slog.LevelInfo))
+
+	cfg, err := config.Load()
+	if err != nil {
+		fatal("Failed to load configuration", err)
+	}
+	level, _ := cfg.SlogLevel()
+	slog.SetDefault(microServerMainFiles.NewLogger(os.Stdout, level))
+
+	flushTracing, err := microServerMainFiles.InitTracing(context.Background(), cfg.Tracing.ServiceName, cfg.Tracing.Exporter, cfg.Tracing.SampleRatio)
 	if err != nil {
-		log.Fatal("Failed to connect to MongoDB:", err)
-		return
+		fatal("Failed to initialize tracing", err)
+	}
+
+	client, err := connectToMongoDB(cfg.Mongo)
+	if err != nil {
+		fatal("Failed to connect to MongoDB", err)
+	}
+
+	database := client.Database(cfg.Mongo.Database)
+	microServerMainFiles.SetRepositories(microServerMainFiles.NewMongoRepositories(database, client.Database(cfg.Mongo.AuthDatabase)))
+	microServerMainFiles.SetJWTConfig([]byte(cfg.JWT.Key), cfg.JWT.TTL, cfg.JWT.RefreshTTL)
+	microServerMainFiles.SetPasswordPolicy(microServerMainFiles.PasswordPolicy{
+		MinLength:     cfg.Password.MinLength,
+		RequireUpper:  cfg.Password.RequireUpper,
+		RequireLower:  cfg.Password.RequireLower,
+		RequireDigit:  cfg.Password.RequireDigit,
+		RequireSymbol: cfg.Password.RequireSymbol,
+	})
+	microServerMainFiles.SetPasswordResetConfig(cfg.Password.ResetTokenTTL, cfg.Server.PublicURL)
+	if cfg.Password.BreachedList != "" {
+		count, err := microServerMainFiles.LoadBreachedPasswords(cfg.Password.BreachedList)
+		if err != nil {
+			fatal("Failed to load breached password list", err)
+		}
+		slog.Info("Loaded breached password list", "passwords", count)
+	}
+	email.Configure(email.Config{
+		Host:     cfg.SMTP.Host,
+		Port:     cfg.SMTP.Port,
+		Username: cfg.SMTP.Username,
+		Password: cfg.SMTP.Password,
+		From:     cfg.SMTP.From,
+	})
+
+	microServerMainFiles.SetReadinessChecks(map[string]microServerMainFiles.ReadinessCheck{
+		"mongo": func(ctx context.Context) error { return client.Ping(ctx, readpref.Primary()) },
+		"smtp":  email.Ping,
+	})
+
+	if err := microServerMainFiles.InitProductCatalog(); err != nil {
+		fatal("Failed to initialize product catalog", err)
+	}
+	if err := microServerMainFiles.InitProductStock(); err != nil {
+		fatal("Failed to migrate product stock", err)
+	}
+	if err := microServerMainFiles.InitUsers(); err != nil {
+		fatal("Failed to initialize users", err)
+	}
+	if err := microServerMainFiles.InitIdempotencyKeys(); err != nil {
+		fatal("Failed to initialize idempotency keys", err)
+	}
+	if err := microServerMainFiles.InitPasswordResets(); err != nil {
+		fatal("Failed to initialize password resets", err)
+	}
+	if err := microServerMainFiles.InitRefreshTokens(); err != nil {
+		fatal("Failed to initialize refresh tokens", err)
+	}
+	if err := microServerMainFiles.InitRevokedTokens(); err != nil {
+		fatal("Failed to initialize revoked tokens", err)
 	}
-	defer client.Disconnect(context.Background())
+	if err := microServerMainFiles.InitTransactionStatuses(); err != nil {
+		fatal("Failed to migrate transaction statuses", err)
+	}
+	expiryCtx, stopExpiry := context.WithCancel(context.Background())
+	microServerMainFiles.StartTransactionExpiry(expiryCtx, time.Minute)
+
+	server := &http.Server{
+		Addr:         cfg.Server.Addr,
+		Handler:      setupRoutes(cfg),
+		ReadTimeout:  cfg.Server.ReadTimeout,
+		WriteTimeout: cfg.Server.WriteTimeout,
+		IdleTimeout:  cfg.Server.IdleTimeout,
+	}
+
+	serverErr := make(chan error, 1)
+	go func() {
+		slog.Info("Server is running", "addr", cfg.Server.Addr, "env", cfg.Env)
+		serverErr <- server.ListenAndServe()
+	}()
+
+	signals, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
 
-	microServerMainFiles.SetDatabase(client.Database("microServiceDB"))
+	failed := false
+	select {
+	case err := <-serverErr:
+		slog.Error("Server failed", "err", err)
+		failed = true
+	case <-signals.Done():
+		slog.Info("Shutting down", "drain_delay", cfg.Server.DrainDelay)
+	}
+	// A second signal during the drain kills the process straight away
+	stopSignals()
+
+	if !failed {
+		// Keep serving while /readyz tells the load balancer to stop
+		// sending new requests
+		microServerMainFiles.StartDraining()
+		time.Sleep(cfg.Server.DrainDelay)
+	}
+
+	shutdown(server, client, stopExpiry, flushTracing, cfg.Server.ShutdownTimeout)
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// shutdown stops accepting connections, waits for in-flight requests and
+// background jobs to finish, disconnects from MongoDB and flushes the last
+// spans. Everything shares one deadline so the whole sequence fits in timeout.
+func shutdown(server *http.Server, client *mongo.Client, stopExpiry context.CancelFunc, flushTracing func(context.Context) error, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Error("Error draining HTTP requests", "err", err)
+	}
+	stopExpiry()
+	if err := microServerMainFiles.WaitForBackgroundJobs(ctx); err != nil {
+		slog.Warn("Gave up waiting for background jobs", "err", err)
+	}
+	if err := client.Disconnect(ctx); err != nil {
+		slog.Error("Error disconnecting from MongoDB", "err", err)
+	}
+	if err := flushTracing(ctx); err != nil {
+		slog.Error("Error flushing traces", "err", err)
+	}
+	slog.Info("Server stopped")
+}
 
-	mux := setupRoutes()
-	log.Println("Server is running on port 8080...")
-	log.Fatal(http.ListenAndServe(":8080", mux))
+// fatal logs err and exits
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
 }
 
-func connectToMongoDB() (*mongo.Client, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+func connectToMongoDB(cfg config.MongoConfig) (*mongo.Client, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ConnectTimeout)
 	defer cancel()
 
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://localhost:27017"))
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(cfg.URI).SetMonitor(microServerMainFiles.MongoCommandMonitor()))
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,391 @@
+package config
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	EnvDevelopment = "dev"
+	EnvStaging     = "staging"
+	EnvProduction  = "prod"
+)
+
+// minJWTKeyLength is the shortest HS256 signing key accepted, in bytes
+const minJWTKeyLength = 32
+
+// Config holds everything that differs between deployments
+type Config struct {
+	Env      string         `yaml:"env"`
+	LogLevel string         `yaml:"log_level"`
+	Server   ServerConfig   `yaml:"server"`
+	Mongo    MongoConfig    `yaml:"mongo"`
+	JWT      JWTConfig      `yaml:"jwt"`
+	SMTP     SMTPConfig     `yaml:"smtp"`
+	Password PasswordConfig `yaml:"password"`
+	Tracing  TracingConfig  `yaml:"tracing"`
+}
+
+type ServerConfig struct {
+	Addr string `yaml:"addr"`
+	// PublicURL is where users reach the site, used for links in emails
+	PublicURL    string        `yaml:"public_url"`
+	StaticDir    string        `yaml:"static_dir"`
+	ReadTimeout  time.Duration `yaml:"read_timeout"`
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+	IdleTimeout  time.Duration `yaml:"idle_timeout"`
+	// DrainDelay is how long the server keeps serving while reporting not
+	// ready after a shutdown signal, so load balancers stop routing to it
+	DrainDelay time.Duration `yaml:"drain_delay"`
+	// ShutdownTimeout is how long in-flight requests and background jobs
+	// get to finish once the server stops accepting connections
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+}
+
+type MongoConfig struct {
+	URI            string        `yaml:"uri"`
+	Database       string        `yaml:"database"`
+	AuthDatabase   string        `yaml:"auth_database"`
+	ConnectTimeout time.Duration `yaml:"connect_timeout"`
+}
+
+type JWTConfig struct {
+	Key string `yaml:"key"`
+	// TTL is the lifetime of access tokens; RefreshTTL that of the refresh
+	// tokens they are renewed with
+	TTL        time.Duration `yaml:"ttl"`
+	RefreshTTL time.Duration `yaml:"refresh_ttl"`
+}
+
+type SMTPConfig struct {
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	From     string `yaml:"from"`
+}
+
+// PasswordConfig is the policy user-chosen passwords are checked against
+type PasswordConfig struct {
+	MinLength     int  `yaml:"min_length"`
+	RequireUpper  bool `yaml:"require_upper"`
+	RequireLower  bool `yaml:"require_lower"`
+	RequireDigit  bool `yaml:"require_digit"`
+	RequireSymbol bool `yaml:"require_symbol"`
+	// BreachedList is an optional file of leaked passwords to reject, one
+	// per line, either in plain text or as SHA-1 hashes
+	BreachedList string `yaml:"breached_list"`
+	// ResetTokenTTL is how long an emailed password reset link works
+	ResetTokenTTL time.Duration `yaml:"reset_token_ttl"`
+}
+
+type TracingConfig struct {
+	// Exporter is where spans are sent: none, stdout, or otlp to the
+	// collector named by the standard OTEL_EXPORTER_OTLP_* variables
+	Exporter    string  `yaml:"exporter"`
+	ServiceName string  `yaml:"service_name"`
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+// Default returns the configuration used for anything not set in the file
+// or environment
+func Default() Config {
+	return Config{
+		Env:      EnvDevelopment,
+		LogLevel: "info",
+		Server: ServerConfig{
+			Addr:      ":8080",
+			PublicURL: "http://localhost:8080",
+			StaticDir: "web",
+			// Payments can spend up to 30s at the gateway before the
+			// receipt is sent, so writes get well over that
+			ReadTimeout:     15 * time.Second,
+			WriteTimeout:    90 * time.Second,
+			IdleTimeout:     2 * time.Minute,
+			DrainDelay:      5 * time.Second,
+			ShutdownTimeout: 30 * time.Second,
+		},
+		Mongo: MongoConfig{
+			URI:            "mongodb://localhost:27017",
+			Database:       "microServiceDB",
+			AuthDatabase:   "authDB",
+			ConnectTimeout: 10 * time.Second,
+		},
+		JWT: JWTConfig{
+			TTL:        15 * time.Minute,
+			RefreshTTL: 30 * 24 * time.Hour,
+		},
+		SMTP: SMTPConfig{
+			Host: "smtp.gmail.com",
+			Port: 587,
+		},
+		Password: PasswordConfig{
+			MinLength:     12,
+			ResetTokenTTL: 30 * time.Minute,
+		},
+		Tracing: TracingConfig{
+			Exporter:    "none",
+			ServiceName: "microService",
+			SampleRatio: 1,
+		},
+	}
+}
+
+// Load builds the configuration from the defaults, then the YAML file named
+// by CONFIG_FILE if set, then environment variables, each overriding the
+// last, and validates the result.
+func Load() (*Config, error) {
+	cfg := Default()
+
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading config file: %w", err)
+		}
+		if err := yaml.Unmarshal(data, &cfg); err != nil {
+			return nil, fmt.Errorf("parsing config file %s: %w", path, err)
+		}
+	}
+
+	if err := applyEnv(&cfg); err != nil {
+		return nil, err
+	}
+
+	if cfg.SMTP.From == "" {
+		cfg.SMTP.From = cfg.SMTP.Username
+	}
+
+	// Development shouldn't need a secret to start; tokens just won't survive
+	// a restart
+	if cfg.JWT.Key == "" && cfg.Env == EnvDevelopment {
+		key := make([]byte, minJWTKeyLength)
+		if _, err := rand.Read(key); err != nil {
+			return nil, fmt.Errorf("generating development JWT key: %w", err)
+		}
+		cfg.JWT.Key = base64.RawURLEncoding.EncodeToString(key)
+		slog.Warn("JWT_KEY not set, using a random key for this process")
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+func applyEnv(cfg *Config) error {
+	setString := func(name string, target *string) {
+		if v, ok := os.LookupEnv(name); ok {
+			*target = v
+		}
+	}
+	setDuration := func(name string, target *time.Duration) error {
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return nil
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		*target = d
+		return nil
+	}
+	setInt := func(name string, target *int) error {
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return nil
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		*target = n
+		return nil
+	}
+	setBool := func(name string, target *bool) error {
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return nil
+		}
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		*target = b
+		return nil
+	}
+	setFloat := func(name string, target *float64) error {
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return nil
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		*target = f
+		return nil
+	}
+
+	setString("APP_ENV", &cfg.Env)
+	setString("LOG_LEVEL", &cfg.LogLevel)
+	setString("SERVER_ADDR", &cfg.Server.Addr)
+	setString("PUBLIC_URL", &cfg.Server.PublicURL)
+	setString("STATIC_DIR", &cfg.Server.StaticDir)
+	setString("MONGO_URI", &cfg.Mongo.URI)
+	setString("MONGO_DATABASE", &cfg.Mongo.Database)
+	setString("MONGO_AUTH_DATABASE", &cfg.Mongo.AuthDatabase)
+	setString("JWT_KEY", &cfg.JWT.Key)
+	setString("SMTP_HOST", &cfg.SMTP.Host)
+	setString("SMTP_USERNAME", &cfg.SMTP.Username)
+	setString("SMTP_PASSWORD", &cfg.SMTP.Password)
+	setString("SMTP_FROM", &cfg.SMTP.From)
+	setString("PASSWORD_BREACHED_LIST", &cfg.Password.BreachedList)
+	setString("TRACING_EXPORTER", &cfg.Tracing.Exporter)
+	setString("TRACING_SERVICE_NAME", &cfg.Tracing.ServiceName)
+
+	durations := []struct {
+		name   string
+		target *time.Duration
+	}{
+		{"SERVER_READ_TIMEOUT", &cfg.Server.ReadTimeout},
+		{"SERVER_WRITE_TIMEOUT", &cfg.Server.WriteTimeout},
+		{"SERVER_IDLE_TIMEOUT", &cfg.Server.IdleTimeout},
+		{"SERVER_DRAIN_DELAY", &cfg.Server.DrainDelay},
+		{"SERVER_SHUTDOWN_TIMEOUT", &cfg.Server.ShutdownTimeout},
+		{"MONGO_CONNECT_TIMEOUT", &cfg.Mongo.ConnectTimeout},
+		{"PASSWORD_RESET_TOKEN_TTL", &cfg.Password.ResetTokenTTL},
+		{"JWT_TTL", &cfg.JWT.TTL},
+		{"JWT_REFRESH_TTL", &cfg.JWT.RefreshTTL},
+	}
+	for _, d := range durations {
+		if err := setDuration(d.name, d.target); err != nil {
+			return err
+		}
+	}
+	bools := []struct {
+		name   string
+		target *bool
+	}{
+		{"PASSWORD_REQUIRE_UPPER", &cfg.Password.RequireUpper},
+		{"PASSWORD_REQUIRE_LOWER", &cfg.Password.RequireLower},
+		{"PASSWORD_REQUIRE_DIGIT", &cfg.Password.RequireDigit},
+		{"PASSWORD_REQUIRE_SYMBOL", &cfg.Password.RequireSymbol},
+	}
+	for _, b := range bools {
+		if err := setBool(b.name, b.target); err != nil {
+			return err
+		}
+	}
+	if err := setFloat("TRACING_SAMPLE_RATIO", &cfg.Tracing.SampleRatio); err != nil {
+		return err
+	}
+	if err := setInt("PASSWORD_MIN_LENGTH", &cfg.Password.MinLength); err != nil {
+		return err
+	}
+	return setInt("SMTP_PORT", &cfg.SMTP.Port)
+}
+
+// SlogLevel parses LogLevel, one of debug, info, warn or error
+func (c *Config) SlogLevel() (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(c.LogLevel))
+	return level, err
+}
+
+// Validate reports every problem with the configuration at once
+func (c *Config) Validate() error {
+	var problems []string
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	switch c.Env {
+	case EnvDevelopment, EnvStaging, EnvProduction:
+	default:
+		add("env must be one of %s, %s, %s", EnvDevelopment, EnvStaging, EnvProduction)
+	}
+	if _, err := c.SlogLevel(); err != nil {
+		add("log_level must be one of debug, info, warn, error")
+	}
+	if c.Server.Addr == "" {
+		add("server.addr is required")
+	}
+	if u, err := url.Parse(c.Server.PublicURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		add("server.public_url must be an absolute http or https URL")
+	}
+	if c.Server.ReadTimeout <= 0 || c.Server.WriteTimeout <= 0 || c.Server.IdleTimeout <= 0 {
+		add("server.read_timeout, server.write_timeout and server.idle_timeout must be positive")
+	}
+	if c.Server.DrainDelay < 0 {
+		add("server.drain_delay cannot be negative")
+	}
+	if c.Server.ShutdownTimeout <= 0 {
+		add("server.shutdown_timeout must be positive")
+	}
+	if c.Mongo.URI == "" {
+		add("mongo.uri is required")
+	}
+	if c.Mongo.Database == "" {
+		add("mongo.database is required")
+	}
+	if c.Mongo.AuthDatabase == "" {
+		add("mongo.auth_database is required")
+	}
+	if c.Mongo.ConnectTimeout <= 0 {
+		add("mongo.connect_timeout must be positive")
+	}
+	if len(c.JWT.Key) < minJWTKeyLength {
+		add("jwt.key must be at least %d bytes", minJWTKeyLength)
+	}
+	if c.JWT.TTL <= 0 {
+		add("jwt.ttl must be positive")
+	}
+	if c.JWT.RefreshTTL < c.JWT.TTL {
+		add("jwt.refresh_ttl must be at least jwt.ttl")
+	}
+	if c.SMTP.Host == "" {
+		add("smtp.host is required")
+	}
+	if c.SMTP.Port <= 0 || c.SMTP.Port > 65535 {
+		add("smtp.port must be between 1 and 65535")
+	}
+	// NIST SP 800-63B asks for at least 8 characters
+	if c.Password.MinLength < 8 {
+		add("password.min_length must be at least 8")
+	}
+	if c.Password.ResetTokenTTL <= 0 {
+		add("password.reset_token_ttl must be positive")
+	}
+	switch c.Tracing.Exporter {
+	case "none", "stdout", "otlp":
+	default:
+		add("tracing.exporter must be one of none, stdout, otlp")
+	}
+	if c.Tracing.ServiceName == "" {
+		add("tracing.service_name is required")
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		add("tracing.sample_ratio must be between 0 and 1")
+	}
+	if c.Env != EnvDevelopment {
+		if c.SMTP.Username == "" || c.SMTP.Password == "" {
+			add("smtp.username and smtp.password are required outside %s", EnvDevelopment)
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid configuration: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package microServerMainFiles
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// ChangeAccountPassword handles POST /api/account/password, which replaces
+// the caller's password given their current one:
+// {"current_password": "...", "new_password": "..."}
+func ChangeAccountPassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, r)
+		return
+	}
+
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		slog.WarnContext(r.Context(), "User ID not found in context")
+		writeError(w, r, errNoUser)
+		return
+	}
+
+	var request struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, r, errInvalidBody)
+		return
+	}
+
+	if err := ChangePassword(r.Context(), userID, request.CurrentPassword, request.NewPassword); err != nil {
+		if err == ErrIncorrectPassword {
+			slog.WarnContext(r.Context(), "Password change with incorrect current password")
+		}
+		writeError(w, r, err)
+		return
+	}
+
+	// Whoever knew the old password may be logged in elsewhere
+	sessionID, _ := r.Context().Value("sessionID").(string)
+	if err := EndOtherSessions(detachedContext(r), userID, sessionID); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to end other sessions after password change", "err", err)
+	}
+
+	slog.InfoContext(r.Context(), "Password changed")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// AccountSessions handles GET /api/account/sessions, which lists the
+// caller's active sessions with the device and IP address they were last
+// used from
+func AccountSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, r)
+		return
+	}
+
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		slog.WarnContext(r.Context(), "User ID not found in context")
+		writeError(w, r, errNoUser)
+		return
+	}
+	sessionID, _ := r.Context().Value("sessionID").(string)
+
+	sessions, err := ListSessions(r.Context(), userID, sessionID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessions)
+}
+
+// AccountSession handles DELETE /api/account/sessions/{id}, which logs the
+// caller out of one of their sessions, the current one included
+func AccountSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeMethodNotAllowed(w, r)
+		return
+	}
+
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		slog.WarnContext(r.Context(), "User ID not found in context")
+		writeError(w, r, errNoUser)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/api/account/sessions/")
+	if id == "" || strings.Contains(id, "/") {
+		writeError(w, r, errSessionNotFound)
+		return
+	}
+
+	if err := EndUserSession(detachedContext(r), userID, id); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Session ended", "session_id", id)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,55 @@
+package microServerMainFiles
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"log/slog"
+	"time"
+)
+
+// AuditEntry records an operation on a transaction that must stay traceable,
+// including after the transaction itself has been purged
+type AuditEntry struct {
+	Action        string             `bson:"action"`
+	Actor         string             `bson:"actor"`
+	TransactionID primitive.ObjectID `bson:"transaction_id"`
+	UserID        string             `bson:"user_id"`
+	Status        TransactionStatus  `bson:"status"`
+	TotalAmount   float64            `bson:"total_amount"`
+	At            time.Time          `bson:"at"`
+}
+
+// RecordAudit appends an entry to the audit log for an action taken on
+// transaction
+func RecordAudit(ctx context.Context, action, actor string, transaction *Transaction) error {
+	err := auditLog.Record(ctx, AuditEntry{
+		Action:        action,
+		Actor:         actor,
+		TransactionID: transaction.ID,
+		UserID:        transaction.UserID,
+		Status:        transaction.Status,
+		TotalAmount:   transaction.TotalAmount,
+		At:            time.Now(),
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Error writing audit entry", "action", action, "transaction_id", transaction.ID.Hex(), "err", err)
+	}
+	return err
+}
+
+// MongoAuditLog stores audit entries in the audit_log collection
+type MongoAuditLog struct {
+	collection *mongo.Collection
+}
+
+// NewMongoAuditLog returns an AuditLog backed by the audit_log collection of
+// database
+func NewMongoAuditLog(database *mongo.Database) *MongoAuditLog {
+	return &MongoAuditLog{collection: database.Collection("audit_log")}
+}
+
+func (l *MongoAuditLog) Record(ctx context.Context, entry AuditEntry) error {
+	_, err := l.collection.InsertOne(ctx, entry)
+	return err
+}
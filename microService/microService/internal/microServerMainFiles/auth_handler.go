@@ -2,25 +2,31 @@ package microServerMainFiles
 
 import (
 	"encoding/json"
-	"log"
+	"log/slog"
 	"net/http"
+	"strings"
 )
 
 func SignUp(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
-		http.Error(w, "Unsupported method", http.StatusMethodNotAllowed)
+		writeMethodNotAllowed(w, r)
 		return
 	}
 	var request struct {
-		Email string `json:"email"`
+		Email    string `json:"email"`
+		Password string `json:"password"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+		writeError(w, r, errInvalidBody)
 		return
 	}
-	user := UserCredentials{Email: request.Email}
-	if err := RegisterUser(user); err != nil {
-		http.Error(w, "Failed to register user", http.StatusInternalServerError)
+	if strings.TrimSpace(request.Email) == "" {
+		writeError(w, r, Validation("invalid_signup", "Email is required", FieldError{Field: "email", Message: "is required"}))
+		return
+	}
+	user := UserCredentials{Email: request.Email, Password: request.Password}
+	if err := RegisterUser(r.Context(), user); err != nil {
+		writeError(w, r, err)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
@@ -28,28 +34,28 @@ func SignUp(w http.ResponseWriter, r *http.Request) {
 
 func Login(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
-		http.Error(w, "Unsupported method", http.StatusMethodNotAllowed)
+		writeMethodNotAllowed(w, r)
 		return
 	}
 	var user UserCredentials
 	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+		writeError(w, r, errInvalidBody)
 		return
 	}
-	if err := AuthenticateUser(user); err != nil {
-		http.Error(w, "Authentication failed", http.StatusUnauthorized)
+	storedUser, err := AuthenticateUser(r.Context(), user)
+	if err != nil {
+		writeError(w, r, Unauthorized("authentication_failed", "Authentication failed"))
 		return
 	}
 
-	// Generate JWT Token
-	token, err := GenerateJWT(user.Email)
+	// Generate the access and refresh tokens
+	pair, err := StartSession(r.Context(), storedUser, sessionClient(r))
 	if err != nil {
-		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
-	// Return the token in the response
-	log.Printf("Generated token for user %s: %s", user.Email, token)
-	w.Header().Set("Authorization", "Bearer "+token)
-	w.WriteHeader(http.StatusOK)
+	// Return the tokens in the response
+	slog.InfoContext(r.Context(), "User logged in", "user", storedUser.Email)
+	writeTokenPair(w, pair)
 }
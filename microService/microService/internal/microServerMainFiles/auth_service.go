@@ -1,47 +1,87 @@
 package microServerMainFiles
 
 import (
+	"context"
 	"errors"
 	"golang.org/x/crypto/bcrypt"
-	"math/rand"
-	"microService/pkg/email"
+	"time"
 )
 
+// RoleAdmin is granted to users allowed to manage the product catalog
+const RoleAdmin = "admin"
+
 type UserCredentials struct {
 	Email    string `json:"email"`
-	Password string `json:"password"` // This should be hashed before storage
+	Password string `json:"password"`                // This should be hashed before storage
+	Role     string `bson:"role,omitempty" json:"-"` // Set directly in the database, never from requests
+	// SessionsValidAfter is when the user's sessions were last revoked;
+	// tokens issued before it are rejected
+	SessionsValidAfter time.Time `bson:"sessions_valid_after,omitempty" json:"-"`
+	// EmailVerified is set once the user follows the emailed link. The hash
+	// of that link's token and its expiry are kept until then.
+	EmailVerified         bool      `bson:"email_verified" json:"-"`
+	VerificationTokenHash string    `bson:"verification_token_hash,omitempty" json:"-"`
+	VerificationExpiresAt time.Time `bson:"verification_expires_at,omitempty" json:"-"`
 }
 
-func RegisterUser(user UserCredentials) error {
-	password := GenerateRandomPassword()
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+// RegisterUser stores a new user with the password they chose, which must
+// pass CheckPassword
+func RegisterUser(ctx context.Context, user UserCredentials) error {
+	if err := CheckPassword(user.Password, user.Email); err != nil {
+		return err
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
 	if err != nil {
 		return err // return error if hashing failed
 	}
 	user.Password = string(hashedPassword) // Save hashed password
-	if err := SaveUser(user); err != nil {
+	if err := users.Save(ctx, user); err != nil {
+		if err == ErrDuplicate {
+			return Conflict("email_taken", "An account with this email already exists")
+		}
 		return err
 	}
-	return email.SendEmail(user.Email, "Your Password", "Your password is: "+password)
+	sendVerificationInBackground(ctx, user.Email)
+	return nil
 }
 
-func AuthenticateUser(user UserCredentials) error {
-	storedUser, err := GetUserByEmail(user.Email)
+func AuthenticateUser(ctx context.Context, user UserCredentials) (UserCredentials, error) {
+	storedUser, err := users.GetByEmail(ctx, user.Email)
 	if err != nil {
-		return err
+		return UserCredentials{}, err
 	}
 	// Compare the provided password with the stored hashed password
 	if err := bcrypt.CompareHashAndPassword([]byte(storedUser.Password), []byte(user.Password)); err != nil {
-		return errors.New("authentication failed")
+		return UserCredentials{}, errors.New("authentication failed")
 	}
-	return nil
+	return storedUser, nil
 }
 
-func GenerateRandomPassword() string {
-	const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
-	b := make([]byte, 10)
-	for i := range b {
-		b[i] = letters[rand.Intn(len(letters))]
+// ErrIncorrectPassword is returned by ChangePassword when the current
+// password given does not match
+var ErrIncorrectPassword = Validation("incorrect_password", "Current password is incorrect", FieldError{Field: "current_password", Message: "is incorrect"})
+
+// ChangePassword replaces the password of the user with email after
+// checking their current one. The new password must pass CheckPassword and
+// differ from the current one.
+func ChangePassword(ctx context.Context, email, currentPassword, newPassword string) error {
+	storedUser, err := users.GetByEmail(ctx, email)
+	if err != nil {
+		return err
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(storedUser.Password), []byte(currentPassword)); err != nil {
+		return ErrIncorrectPassword
+	}
+	if newPassword == currentPassword {
+		return Validation("password_unchanged", "New password must differ from the current one", FieldError{Field: "new_password", Message: "must differ from the current password"})
+	}
+	if err := checkPassword("new_password", newPassword, email); err != nil {
+		return err
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return err
 	}
-	return string(b)
+	return users.UpdatePassword(ctx, email, string(hashedPassword))
 }
@@ -0,0 +1,35 @@
+package microServerMainFiles
+
+import (
+	"context"
+	"sync"
+)
+
+// backgroundJobs tracks work started after a response has been sent, such
+// as best-effort emails, so shutdown can wait for it
+var backgroundJobs sync.WaitGroup
+
+// runInBackground runs job in its own goroutine, tracked by backgroundJobs
+func runInBackground(job func()) {
+	backgroundJobs.Add(1)
+	go func() {
+		defer backgroundJobs.Done()
+		job()
+	}()
+}
+
+// WaitForBackgroundJobs blocks until every job started with runInBackground
+// has finished, or returns ctx's error if it is done first
+func WaitForBackgroundJobs(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		backgroundJobs.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -3,12 +3,13 @@ package microServerMainFiles
 import (
 	"context"
 	"encoding/json"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
 	"microService/pkg/email"
+	paymentpkg "microService/pkg/payment"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -26,62 +27,166 @@ type PaymentForm struct {
 	Address        string `json:"address"`
 }
 
+// Card returns the normalized card details from the form
+func (p PaymentForm) Card() paymentpkg.Card {
+	return paymentpkg.Card{
+		Number:         p.CardNumber,
+		ExpirationDate: p.ExpirationDate,
+		CVV:            p.CVV,
+		Name:           p.Name,
+	}.Normalize()
+}
+
+// String redacts the form so logging it never leaks the card number or CVV
+func (p PaymentForm) String() string {
+	return fmt.Sprintf("{Card:%s Name:%s}", p.Card().Masked(), p.Name)
+}
+
+// GoString covers %#v, which would otherwise print every field
+func (p PaymentForm) GoString() string {
+	return "PaymentForm" + p.String()
+}
+
 // AddProductToCart adds a product to the user's shopping cart
 func AddProductToCart(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		writeMethodNotAllowed(w, r)
 		return
 	}
 
 	var item CartItem
 	if err := json.NewDecoder(r.Body).Decode(&item); err != nil {
-		log.Printf("Error decoding request body: %v", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		slog.WarnContext(r.Context(), "Error decoding request body", "err", err)
+		writeError(w, r, errInvalidBody)
 		return
 	}
 
-	// Log the item received
-	log.Printf("Received item: %+v", item)
-
 	if item.ProductID == "" {
-		log.Println("Product ID is empty")
-		http.Error(w, "Product ID is required", http.StatusBadRequest)
+		slog.WarnContext(r.Context(), "Product ID is empty")
+		writeError(w, r, Validation("invalid_item", "Invalid cart item", FieldError{Field: "product_id", Message: "is required"}))
+		return
+	}
+	if item.Quantity <= 0 {
+		writeError(w, r, errQuantityNotPositive)
 		return
 	}
 
 	userID, ok := r.Context().Value("userID").(string)
 	if !ok {
-		log.Println("User ID not found in context")
-		http.Error(w, "User ID not found in context", http.StatusUnauthorized)
+		slog.WarnContext(r.Context(), "User ID not found in context")
+		writeError(w, r, errNoUser)
 		return
 	}
 
-	log.Printf("Adding item to cart for user %s: %+v", userID, item)
+	// The catalog is the only source of truth for prices; whatever the
+	// client sent in the price field is discarded
+	product, err := RetrieveProduct(r.Context(), item.ProductID)
+	if err != nil {
+		if err == ErrNotFound {
+			slog.WarnContext(r.Context(), "Unknown product", "product_id", item.ProductID)
+			writeError(w, r, Validation("unknown_product", "Unknown product", FieldError{Field: "product_id", Message: "is not in the catalog"}))
+			return
+		}
+		writeError(w, r, err)
+		return
+	}
+	item.Price = product.Price
+
+	slog.DebugContext(r.Context(), "Adding item to cart", "product_id", item.ProductID, "quantity", item.Quantity)
 
-	if err := AddItemToUserCart(userID, item); err != nil {
-		log.Printf("Failed to add item to cart for user %s: %v", userID, err)
-		http.Error(w, "Failed to add item to cart", http.StatusInternalServerError)
+	if err := AddItemToUserCart(r.Context(), userID, item); err != nil {
+		writeError(w, r, err)
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
 }
 
-// AddItemToUserCart handles the logic to add an item to the cart
-func AddItemToUserCart(userID string, item CartItem) error {
-	collection := db.Collection("carts")
+// AddItemToUserCart adds an item to the cart, merging it into the existing
+// line for the same product so each product appears at most once
+func AddItemToUserCart(ctx context.Context, userID string, item CartItem) error {
+	created, err := carts.AddItem(ctx, userID, item)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error updating cart in database", "user", userID, "err", err)
+		return err
+	}
+	if created {
+		cartsCreated.Inc()
+	}
+	return nil
+}
+
+// CartItemByProductID handles /api/cart/items/{productId}: PATCH sets the
+// quantity of a line, DELETE removes it
+func CartItemByProductID(w http.ResponseWriter, r *http.Request) {
+	productID := strings.TrimPrefix(r.URL.Path, "/api/cart/items/")
+	if productID == "" || strings.Contains(productID, "/") {
+		writeError(w, r, errProductIDRequired)
+		return
+	}
 
-	// Add logging to check item before database operation
-	log.Printf("Inserting item into cart: %+v", item)
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		slog.WarnContext(r.Context(), "User ID not found in context")
+		writeError(w, r, errNoUser)
+		return
+	}
+
+	var err error
+	switch r.Method {
+	case http.MethodPatch:
+		var request struct {
+			Quantity int `json:"quantity"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			slog.WarnContext(r.Context(), "Error decoding request body", "err", err)
+			writeError(w, r, errInvalidBody)
+			return
+		}
+		if request.Quantity <= 0 {
+			writeError(w, r, errQuantityNotPositive)
+			return
+		}
+		err = UpdateCartItemQuantity(r.Context(), userID, productID, request.Quantity)
+	case http.MethodDelete:
+		err = RemoveCartItem(r.Context(), userID, productID)
+	default:
+		writeMethodNotAllowed(w, r)
+		return
+	}
+	if err != nil {
+		if err == ErrNotFound {
+			err = NotFound("cart_item_not_found", "Product not in cart")
+		}
+		writeError(w, r, err)
+		return
+	}
 
-	_, err := collection.UpdateOne(
-		context.TODO(),
-		bson.M{"user_id": userID},
-		bson.M{"$push": bson.M{"items": item}}, // Ensure the correct nesting of maps
-		options.Update().SetUpsert(true),
-	)
+	cart, err := carts.Get(r.Context(), userID)
 	if err != nil {
-		log.Printf("Error updating cart in database: %v", err)
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cart)
+}
+
+// UpdateCartItemQuantity sets the quantity of the cart line for productID,
+// returning ErrNotFound if the cart has no such line
+func UpdateCartItemQuantity(ctx context.Context, userID, productID string, quantity int) error {
+	err := carts.SetItemQuantity(ctx, userID, productID, quantity)
+	if err != nil && err != ErrNotFound {
+		slog.ErrorContext(ctx, "Error updating cart item quantity", "user", userID, "product_id", productID, "err", err)
+	}
+	return err
+}
+
+// RemoveCartItem removes the cart line for productID, returning ErrNotFound
+// if the cart has no such line
+func RemoveCartItem(ctx context.Context, userID, productID string) error {
+	err := carts.RemoveItem(ctx, userID, productID)
+	if err != nil && err != ErrNotFound {
+		slog.ErrorContext(ctx, "Error removing cart item", "user", userID, "product_id", productID, "err", err)
 	}
 	return err
 }
@@ -90,116 +195,163 @@ func AddItemToUserCart(userID string, item CartItem) error {
 func GetCart(w http.ResponseWriter, r *http.Request) {
 	userID, ok := r.Context().Value("userID").(string)
 	if !ok {
-		log.Println("User ID not found in context")
-		http.Error(w, "User ID not found in context", http.StatusUnauthorized)
+		slog.WarnContext(r.Context(), "User ID not found in context")
+		writeError(w, r, errNoUser)
 		return
 	}
 
-	cart, err := RetrieveUserCart(userID)
+	cart, err := carts.Get(r.Context(), userID)
 	if err != nil {
-		log.Printf("Unable to retrieve cart for user %s: %v", userID, err)
-		http.Error(w, "Unable to retrieve cart", http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
-	log.Printf("Cart for user %s: %+v", userID, cart)
+	slog.DebugContext(r.Context(), "Retrieved cart", "items", len(cart.Items))
 	json.NewEncoder(w).Encode(cart)
 }
 
-// RetrieveUserCart retrieves the cart from the database
-func RetrieveUserCart(userID string) (*Cart, error) {
-	collection := db.Collection("carts")
-	var cart Cart
-	err := collection.FindOne(context.TODO(), bson.M{"user_id": userID}).Decode(&cart)
-	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			log.Printf("No cart found for user %s, returning empty cart", userID)
-			return &Cart{UserID: userID, Items: []CartItem{}}, nil // Return empty cart if not found
-		}
-		log.Printf("Error finding cart in database for user %s: %v", userID, err)
-		return nil, err
-	}
-	return &cart, nil
-}
-
 // ClearCart clears a user's shopping cart
 func ClearCart(w http.ResponseWriter, r *http.Request) {
 	userID, ok := r.Context().Value("userID").(string)
 	if !ok {
-		log.Println("User ID not found in context")
-		http.Error(w, "User ID not found in context", http.StatusUnauthorized)
+		slog.WarnContext(r.Context(), "User ID not found in context")
+		writeError(w, r, errNoUser)
 		return
 	}
 
-	err := ClearUserCart(userID)
+	err := carts.Clear(r.Context(), userID)
 	if err != nil {
-		log.Printf("Unable to clear cart for user %s: %v", userID, err)
-		http.Error(w, "Unable to clear cart", http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
 }
 
-// ClearUserCart removes all items from the user's cart in the database
-func ClearUserCart(userID string) error {
-	collection := db.Collection("carts")
-	_, err := collection.UpdateOne(
-		context.TODO(),
-		bson.M{"user_id": userID},
-		bson.M{"$set": bson.M{"items": []CartItem{}}}, // Clear the items array
-	)
-	if err != nil {
-		log.Printf("Error clearing cart in database for user %s: %v", userID, err)
-	}
-	return err
-}
-
 // Checkout creates a transaction from the cart
 func Checkout(w http.ResponseWriter, r *http.Request) {
 	userID, ok := r.Context().Value("userID").(string)
 	if !ok {
-		log.Println("User ID not found in context")
-		http.Error(w, "User ID not found in context", http.StatusUnauthorized)
+		slog.WarnContext(r.Context(), "User ID not found in context")
+		writeError(w, r, errNoUser)
 		return
 	}
 
-	transaction, err := CreateTransactionFromCart(userID)
+	if !isEmailVerified(r) {
+		checkouts.WithLabelValues("unverified").Inc()
+		writeError(w, r, errEmailUnverified)
+		return
+	}
+
+	transaction, err := CreateTransactionFromCart(r.Context(), userID)
 	if err != nil {
-		log.Printf("Unable to create transaction for user %s: %v", userID, err)
-		http.Error(w, "Unable to create transaction", http.StatusInternalServerError)
+		switch {
+		case err == ErrEmptyCart:
+			checkouts.WithLabelValues("empty_cart").Inc()
+		case errors.As(err, new(*InsufficientStockError)):
+			checkouts.WithLabelValues("insufficient_stock").Inc()
+			slog.InfoContext(r.Context(), "Checkout rejected", "err", err)
+		default:
+			checkouts.WithLabelValues("error").Inc()
+		}
+		writeError(w, r, err)
 		return
 	}
-	log.Printf("Transaction created for user %s: %+v", userID, transaction)
+	checkouts.WithLabelValues("created").Inc()
+	slog.InfoContext(r.Context(), "Transaction created", "transaction_id", transaction.ID.Hex(), "total", transaction.TotalAmount)
 	json.NewEncoder(w).Encode(transaction)
 }
 
-// CreateTransactionFromCart converts a cart into a transaction
-func CreateTransactionFromCart(userID string) (*Transaction, error) {
-	cart, err := RetrieveUserCart(userID)
+// ErrEmptyCart is returned when checking out a cart with no items, including
+// when a concurrent checkout already turned the cart into a transaction
+var ErrEmptyCart = Conflict("cart_empty", "Cart is empty")
+
+var (
+	errProductIDRequired   = Validation("product_id_required", "Product ID is required")
+	errQuantityNotPositive = Validation("invalid_quantity", "Quantity must be positive", FieldError{Field: "quantity", Message: "must be positive"})
+)
+
+// CreateTransactionFromCart converts a cart into a transaction. Reading the
+// cart, reserving stock, inserting the transaction and clearing the cart run
+// in a single transaction, so either all of them happen or none do.
+// Concurrent checkouts of the same cart conflict on the cart write; the
+// loser is retried, finds the cart empty and fails with ErrEmptyCart.
+func CreateTransactionFromCart(ctx context.Context, userID string) (*Transaction, error) {
+	var transaction *Transaction
+	err := transactor.WithTransaction(ctx, func(ctx context.Context) error {
+		created, err := checkoutCart(ctx, userID)
+		if err != nil {
+			return err
+		}
+		transaction = created
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
+	return transaction, nil
+}
 
-	transaction := &Transaction{
-		UserID:      userID,
-		Items:       cart.Items,
-		TotalAmount: CalculateTotal(cart.Items),
-		Status:      "pending",
-		CreatedAt:   time.Now(),
+func checkoutCart(ctx context.Context, userID string) (*Transaction, error) {
+	cart, err := carts.Get(ctx, userID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error finding cart in database", "user", userID, "err", err)
+		return nil, err
+	}
+	if len(cart.Items) == 0 {
+		return nil, ErrEmptyCart
 	}
 
-	collection := db.Collection("transactions")
-	_, err = collection.InsertOne(context.TODO(), transaction)
+	// Re-price against the catalog so carts saved before server-side pricing
+	// (or before a price change) are billed at the current price
+	items, err := PriceCartItems(ctx, cart.Items)
 	if err != nil {
-		log.Printf("Error creating transaction in database for user %s: %v", userID, err)
 		return nil, err
 	}
 
-	// Optionally clear the cart here
-	ClearUserCart(userID)
+	if err := ReserveStock(ctx, items); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	transaction := &Transaction{
+		UserID:        userID,
+		Items:         items,
+		TotalAmount:   CalculateTotal(items),
+		Status:        StatusPending,
+		StatusHistory: []StatusChange{{To: StatusPending, At: now, Actor: userID}},
+		CreatedAt:     now,
+		ExpiresAt:     now.Add(pendingTransactionTTL),
+		StockReserved: true,
+	}
+
+	if err := transactions.Insert(ctx, transaction); err != nil {
+		slog.ErrorContext(ctx, "Error creating transaction in database", "user", userID, "err", err)
+		return nil, err
+	}
+
+	if err := carts.Clear(ctx, userID); err != nil {
+		slog.ErrorContext(ctx, "Error clearing cart in database", "user", userID, "err", err)
+		return nil, err
+	}
 
 	return transaction, nil
 }
 
+// PriceCartItems returns a copy of items with each price taken from the
+// catalog, failing with ErrNotFound if a product no longer exists
+func PriceCartItems(ctx context.Context, items []CartItem) ([]CartItem, error) {
+	priced := make([]CartItem, len(items))
+	for i, item := range items {
+		product, err := products.Get(ctx, item.ProductID)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error pricing product", "product_id", item.ProductID, "err", err)
+			return nil, err
+		}
+		item.Price = product.Price
+		priced[i] = item
+	}
+	return priced, nil
+}
+
 func CalculateTotal(items []CartItem) float64 {
 	var total float64
 	for _, item := range items {
@@ -208,156 +360,40 @@ func CalculateTotal(items []CartItem) float64 {
 	return total
 }
 
-// ProcessPayment processes the payment for a transaction
-//func ProcessPayment(w http.ResponseWriter, r *http.Request) {
-//	if r.Method != http.MethodPost {
-//		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
-//		return
-//	}
-//
-//	var payment PaymentForm
-//	if err := json.NewDecoder(r.Body).Decode(&payment); err != nil {
-//		log.Printf("Error decoding payment form: %v", err)
-//		http.Error(w, "Invalid request", http.StatusBadRequest)
-//		return
-//	}
-//
-//	// Assume the user ID is retrieved from the JWT token
-//	userID, ok := r.Context().Value("userID").(string)
-//	if !ok {
-//		log.Println("User ID not found in context")
-//		http.Error(w, "User ID not found in context", http.StatusUnauthorized)
-//		return
-//	}
-//
-//	// Retrieve the transaction for the user
-//	transaction, err := RetrievePendingTransaction(userID)
-//	if err != nil {
-//		log.Printf("Failed to retrieve pending transaction for user %s: %v", userID, err)
-//		http.Error(w, "Failed to retrieve transaction", http.StatusInternalServerError)
-//		return
-//	}
-//
-//	// Process the payment (always successful for testing)
-//	log.Printf("Processing payment for user %s: %+v", userID, payment)
-//
-//	// Update the transaction status to "paid"
-//	if err := UpdateTransactionStatus(transaction.ID, "paid"); err != nil {
-//		log.Printf("Failed to update transaction status for user %s: %v", userID, err)
-//		http.Error(w, "Failed to update transaction status", http.StatusInternalServerError)
-//		return
-//	}
-//
-//	log.Printf("Payment processed for user %s: %+v", userID, transaction)
-//	w.WriteHeader(http.StatusOK)
-//}
-
-// ProcessPayment processes the payment for a transaction
-//func ProcessPayment(w http.ResponseWriter, r *http.Request) {
-//	if r.Method != http.MethodPost {
-//		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
-//		return
-//	}
-//
-//	var payment PaymentForm
-//	if err := json.NewDecoder(r.Body).Decode(&payment); err != nil {
-//		log.Printf("Error decoding payment form: %v", err)
-//		http.Error(w, "Invalid request", http.StatusBadRequest)
-//		return
-//	}
-//
-//	// Assume the user ID is retrieved from the JWT token
-//	userID, ok := r.Context().Value("userID").(string)
-//	if !ok {
-//		log.Println("User ID not found in context")
-//		http.Error(w, "User ID not found in context", http.StatusUnauthorized)
-//		return
-//	}
-//
-//	// Retrieve the transaction for the user
-//	transaction, err := RetrievePendingTransaction(userID)
-//	if err != nil {
-//		log.Printf("Failed to retrieve pending transaction for user %s: %v", userID, err)
-//		http.Error(w, "Failed to retrieve transaction", http.StatusInternalServerError)
-//		return
-//	}
-//
-//	// Process the payment (always successful for testing)
-//	log.Printf("Processing payment for user %s: %+v", userID, payment)
-//
-//	// Update the transaction status to "paid"
-//	if err := UpdateTransactionStatus(transaction.ID, "paid"); err != nil {
-//		log.Printf("Failed to update transaction status for user %s: %v", userID, err)
-//		http.Error(w, "Failed to update transaction status", http.StatusInternalServerError)
-//		return
-//	}
-//
-//	// Clear the user's cart after successful payment
-//	if err := ClearUserCart(userID); err != nil {
-//		log.Printf("Failed to clear cart for user %s: %v", userID, err)
-//		http.Error(w, "Failed to clear cart", http.StatusInternalServerError)
-//		return
-//	}
-//
-//	log.Printf("Payment processed for user %s: %+v", userID, transaction)
-//	w.WriteHeader(http.StatusOK)
-//	json.NewEncoder(w).Encode(map[string]string{"redirect": "cart.html"})
-//}
+// errNoPendingTransaction is returned when the user has nothing awaiting
+// payment. It wraps ErrNotFound.
+var errNoPendingTransaction = &Error{Kind: KindNotFound, Code: "no_pending_transaction", Message: "No pending transaction", Err: ErrNotFound}
 
 // RetrievePendingTransaction retrieves the pending transaction for a user
-func RetrievePendingTransaction(userID string) (*Transaction, error) {
-	collection := db.Collection("transactions")
-	var transaction Transaction
-	err := collection.FindOne(context.TODO(), bson.M{"user_id": userID, "status": "pending"}).Decode(&transaction)
+func RetrievePendingTransaction(ctx context.Context, userID string) (*Transaction, error) {
+	transaction, err := transactions.FindPending(ctx, userID, time.Now())
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			log.Printf("No pending transaction found for user %s", userID)
-			return nil, err
+		if err == ErrNotFound {
+			slog.DebugContext(ctx, "No pending transaction found", "user", userID)
+			return nil, errNoPendingTransaction
 		}
-		log.Printf("Error finding transaction in database for user %s: %v", userID, err)
+		slog.ErrorContext(ctx, "Error finding transaction in database", "user", userID, "err", err)
 		return nil, err
 	}
-	return &transaction, nil
-}
-
-// UpdateTransactionStatus updates the status of a transaction
-func UpdateTransactionStatus(transactionID interface{}, status string) error {
-	collection := db.Collection("transactions")
-
-	filter := bson.M{"_id": transactionID}
-	update := bson.M{"$set": bson.M{"status": status}}
-
-	result, err := collection.UpdateOne(context.TODO(), filter, update)
-	if err != nil {
-		log.Printf("Error updating transaction status in database: %v", err)
-		return err
-	}
-
-	if result.ModifiedCount == 0 {
-		log.Printf("No transaction found with ID %v", transactionID)
-		return mongo.ErrNoDocuments
-	}
-
-	return nil
+	return transaction, nil
 }
 
 // GetPendingTransaction retrieves the pending transaction for the user
 func GetPendingTransaction(w http.ResponseWriter, r *http.Request) {
 	userID, ok := r.Context().Value("userID").(string)
 	if !ok {
-		log.Println("User ID not found in context")
-		http.Error(w, "User ID not found in context", http.StatusUnauthorized)
+		slog.WarnContext(r.Context(), "User ID not found in context")
+		writeError(w, r, errNoUser)
 		return
 	}
 
-	transaction, err := RetrievePendingTransaction(userID)
+	transaction, err := RetrievePendingTransaction(r.Context(), userID)
 	if err != nil {
-		log.Printf("Failed to retrieve pending transaction for user %s: %v", userID, err)
-		http.Error(w, "Failed to retrieve transaction", http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
-	log.Printf("Pending transaction for user %s: %+v", userID, transaction)
+	slog.DebugContext(r.Context(), "Retrieved pending transaction", "transaction_id", transaction.ID.Hex())
 	json.NewEncoder(w).Encode(transaction)
 }
 
@@ -365,200 +401,171 @@ func GetPendingTransaction(w http.ResponseWriter, r *http.Request) {
 func GetTransactions(w http.ResponseWriter, r *http.Request) {
 	userID, ok := r.Context().Value("userID").(string)
 	if !ok {
-		log.Println("User ID not found in context")
-		http.Error(w, "User ID not found in context", http.StatusUnauthorized)
+		slog.WarnContext(r.Context(), "User ID not found in context")
+		writeError(w, r, errNoUser)
 		return
 	}
 
-	transactions, err := RetrieveUserTransactions(userID)
+	transactions, err := RetrieveUserTransactions(r.Context(), userID)
 	if err != nil {
-		log.Printf("Failed to retrieve transactions for user %s: %v", userID, err)
-		http.Error(w, "Failed to retrieve transactions", http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
-	log.Printf("Transactions for user %s: %+v", userID, transactions)
+	slog.DebugContext(r.Context(), "Retrieved transactions", "count", len(transactions))
 	json.NewEncoder(w).Encode(transactions)
 }
 
 // RetrieveUserTransactions retrieves all transactions for a user
-func RetrieveUserTransactions(userID string) ([]Transaction, error) {
-	collection := db.Collection("transactions")
-	var transactions []Transaction
-	cursor, err := collection.Find(context.TODO(), bson.M{"user_id": userID})
+func RetrieveUserTransactions(ctx context.Context, userID string) ([]Transaction, error) {
+	list, err := transactions.ListByUser(ctx, userID)
 	if err != nil {
-		log.Printf("Error finding transactions in database for user %s: %v", userID, err)
-		return nil, err
-	}
-	if err = cursor.All(context.TODO(), &transactions); err != nil {
-		log.Printf("Error decoding transactions for user %s: %v", userID, err)
+		slog.ErrorContext(ctx, "Error finding transactions in database", "user", userID, "err", err)
 		return nil, err
 	}
-	return transactions, nil
+	return list, nil
 }
 
-func DeleteLastTransaction(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodDelete {
-		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+// ProcessPayment charges the card in the body for the caller's pending
+// transaction and emails the receipt in the background
+func ProcessPayment(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, r)
+		return
+	}
+
+	var payment PaymentForm
+	if err := json.NewDecoder(r.Body).Decode(&payment); err != nil {
+		slog.WarnContext(r.Context(), "Error decoding payment form", "err", err)
+		writeError(w, r, errInvalidBody)
 		return
 	}
 
 	userID, ok := r.Context().Value("userID").(string)
 	if !ok {
-		log.Println("User ID not found in context")
-		http.Error(w, "User ID not found in context", http.StatusUnauthorized)
+		slog.WarnContext(r.Context(), "User ID not found in context")
+		writeError(w, r, errNoUser)
 		return
 	}
 
-	collection := db.Collection("transactions")
-
-	// Find the last transaction for the user
-	var lastTransaction Transaction
-	err := collection.FindOne(context.TODO(), bson.M{"user_id": userID}, options.FindOne().SetSort(bson.D{{"created_at", -1}})).Decode(&lastTransaction)
-	if err != nil {
-		log.Printf("Error finding last transaction for user %s: %v", userID, err)
-		http.Error(w, "Failed to find last transaction", http.StatusInternalServerError)
+	if !isEmailVerified(r) {
+		writeError(w, r, errEmailUnverified)
 		return
 	}
 
-	// Delete the last transaction
-	_, err = collection.DeleteOne(context.TODO(), bson.M{"_id": lastTransaction.ID})
+	transaction, err := RetrievePendingTransaction(r.Context(), userID)
 	if err != nil {
-		log.Printf("Error deleting last transaction for user %s: %v", userID, err)
-		http.Error(w, "Failed to delete last transaction", http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
-	log.Printf("Last transaction deleted for user %s: %+v", userID, lastTransaction)
-	w.WriteHeader(http.StatusOK)
-}
+	card := payment.Card()
+	if err := card.Validate(time.Now()); err != nil {
+		payments.WithLabelValues("invalid_card").Inc()
+		writeError(w, r, err)
+		return
+	}
+	slog.InfoContext(r.Context(), "Processing payment", "transaction_id", transaction.ID.Hex(), "card", card.Masked().String())
 
-//func ProcessPayment(w http.ResponseWriter, r *http.Request) {
-//	if r.Method != http.MethodPost {
-//		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
-//		return
-//	}
-//
-//	var payment PaymentForm
-//	if err := json.NewDecoder(r.Body).Decode(&payment); err != nil {
-//		log.Printf("Error decoding payment form: %v", err)
-//		http.Error(w, "Invalid request", http.StatusBadRequest)
-//		return
-//	}
-//
-//	userID, ok := r.Context().Value("userID").(string)
-//	if !ok {
-//		log.Println("User ID not found in context")
-//		http.Error(w, "User ID not found in context", http.StatusUnauthorized)
-//		return
-//	}
-//
-//	transaction, err := RetrievePendingTransaction(userID)
-//	if err != nil {
-//		log.Printf("Failed to retrieve pending transaction for user %s: %v", userID, err)
-//		http.Error(w, "Failed to retrieve transaction", http.StatusInternalServerError)
-//		return
-//	}
-//
-//	log.Printf("Processing payment for user %s: %+v", userID, payment)
-//	transaction.Status = "completed"
-//
-//	collection := db.Collection("transactions")
-//	_, err = collection.UpdateOne(
-//		context.TODO(),
-//		bson.M{"_id": transaction.ID},
-//		bson.M{"$set": bson.M{"status": transaction.Status}},
-//	)
-//	if err != nil {
-//		log.Printf("Error updating transaction status in database: %v", err)
-//		http.Error(w, "Failed to update transaction status", http.StatusInternalServerError)
-//		return
-//	}
-//
-//	log.Printf("Payment processed for user %s: %+v", userID, transaction)
-//
-//	// Generate and send receipt
-//	pdf, err := GenerateReceiptPDF(transaction, payment.Name)
-//	if err != nil {
-//		log.Printf("Failed to generate receipt PDF: %v", err)
-//		http.Error(w, "Failed to generate receipt", http.StatusInternalServerError)
-//		return
-//	}
-//
-//	err = email.SendReceiptEmail(userID, "Your Receipt", "Thank you for your purchase!", pdf)
-//	if err != nil {
-//		log.Printf("Failed to send receipt email: %v", err)
-//		http.Error(w, "Failed to send receipt email", http.StatusInternalServerError)
-//		return
-//	}
-//
-//	log.Printf("Receipt sent to user %s", userID)
-//	w.WriteHeader(http.StatusOK)
-//	http.Redirect(w, r, "/cart.html", http.StatusSeeOther) // Redirect to cart.html after successful payment
-//}
+	// From here on the payment is claimed, charged and recorded in several
+	// steps that must not stop halfway if the client disconnects
+	ctx := detachedContext(r)
 
-func ProcessPayment(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	// Claim the transaction before charging so a concurrent payment or expiry
+	// can't act on it at the same time
+	if _, err := UpdateTransactionStatus(ctx, transaction.ID, StatusAwaitingPayment, userID); err != nil {
+		writeTransitionError(w, r, err)
 		return
 	}
 
-	var payment PaymentForm
-	if err := json.NewDecoder(r.Body).Decode(&payment); err != nil {
-		log.Printf("Error decoding payment form: %v", err)
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+	auth, err := chargeCard(ctx, transaction.TotalAmount, card)
+	if err != nil {
+		// Hand the transaction back so the user can try another card
+		if _, revertErr := UpdateTransactionStatus(ctx, transaction.ID, StatusPending, userID); revertErr != nil {
+			slog.ErrorContext(ctx, "Error returning transaction to pending", "transaction_id", transaction.ID.Hex(), "err", revertErr)
+		}
+		payments.WithLabelValues(paymentOutcome(err)).Inc()
+		writePaymentError(w, r, err)
 		return
 	}
-
-	userID, ok := r.Context().Value("userID").(string)
-	if !ok {
-		log.Println("User ID not found in context")
-		http.Error(w, "User ID not found in context", http.StatusUnauthorized)
+	payments.WithLabelValues("approved").Inc()
+	if err := recordPayment(ctx, transaction.ID, auth.ID, card.Masked()); err != nil {
+		compensatePayment(ctx, transaction, auth.ID, userID)
+		writeError(w, r, err)
 		return
 	}
 
-	transaction, err := RetrievePendingTransaction(userID)
+	paid, err := UpdateTransactionStatus(ctx, transaction.ID, StatusPaid, userID)
 	if err != nil {
-		log.Printf("Failed to retrieve pending transaction for user %s: %v", userID, err)
-		http.Error(w, "Failed to retrieve transaction", http.StatusInternalServerError)
+		compensatePayment(ctx, transaction, auth.ID, userID)
+		writeTransitionError(w, r, err)
 		return
 	}
+	transaction = paid
 
-	log.Printf("Processing payment for user %s: %+v", userID, payment)
-	transaction.Status = "completed"
-
-	collection := db.Collection("transactions")
-	_, err = collection.UpdateOne(
-		context.TODO(),
-		bson.M{"_id": transaction.ID},
-		bson.M{"$set": bson.M{"status": transaction.Status}},
-	)
-	if err != nil {
-		log.Printf("Error updating transaction status in database: %v", err)
-		http.Error(w, "Failed to update transaction status", http.StatusInternalServerError)
-		return
+	if transaction.StockReserved {
+		if err := CommitStock(ctx, transaction.Items); err != nil {
+			slog.ErrorContext(ctx, "Error committing stock", "transaction_id", transaction.ID.Hex(), "err", err)
+		}
 	}
 
-	log.Printf("Payment processed for user %s: %+v", userID, transaction)
+	slog.InfoContext(ctx, "Payment processed", "transaction_id", transaction.ID.Hex(), "total", transaction.TotalAmount)
+
+	// The order is paid whatever happens to the receipt, so a failure to
+	// send it is logged rather than reported as a failed payment
+	runInBackground(func() { sendReceipt(ctx, transaction, payment.Name) })
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(struct {
+		Redirect    string       `json:"redirect"`
+		Transaction *Transaction `json:"transaction"`
+	}{"/cart.html", transaction})
+}
 
-	// Generate and send receipt
-	pdf, err := GenerateReceiptPDF(transaction, payment.Name)
+// sendReceipt emails the receipt for a paid transaction, logging rather
+// than returning failures
+func sendReceipt(ctx context.Context, transaction *Transaction, customerName string) {
+	pdf, err := GenerateReceiptPDF(ctx, transaction, customerName)
 	if err != nil {
-		log.Printf("Failed to generate receipt PDF: %v", err)
-		http.Error(w, "Failed to generate receipt", http.StatusInternalServerError)
+		slog.ErrorContext(ctx, "Failed to generate receipt PDF", "transaction_id", transaction.ID.Hex(), "err", err)
 		return
 	}
+	receiptsGenerated.WithLabelValues("receipt").Inc()
 
-	err = email.SendReceiptEmail(userID, "Your Receipt", "Thank you for your purchase!", pdf)
+	err = email.SendReceiptEmail(ctx, transaction.UserID, "Your Receipt", "Thank you for your purchase!", pdf)
 	if err != nil {
-		log.Printf("Failed to send receipt email: %v", err)
-		http.Error(w, "Failed to send receipt email", http.StatusInternalServerError)
+		slog.ErrorContext(ctx, "Failed to send receipt email", "transaction_id", transaction.ID.Hex(), "err", err)
 		return
 	}
+	slog.InfoContext(ctx, "Receipt sent", "transaction_id", transaction.ID.Hex())
+}
 
-	log.Printf("Receipt sent to user %s", userID)
+// paymentOutcome labels a failed charge for the payments metric, along the
+// same lines writePaymentError answers it
+func paymentOutcome(err error) string {
+	switch {
+	case errors.Is(err, paymentpkg.ErrInsufficientFunds):
+		return "insufficient_funds"
+	case paymentpkg.IsDecline(err):
+		return "declined"
+	case errors.Is(err, paymentpkg.ErrTimeout), errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	default:
+		return "error"
+	}
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"redirect": "/cart.html"})
+// writePaymentError answers a failed charge or refund. Declines and timeouts
+// map like any other error; gateway failures are reported as 502.
+func writePaymentError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, paymentpkg.ErrTimeout) || errors.Is(err, context.DeadlineExceeded) {
+		slog.WarnContext(r.Context(), "Payment gateway timed out", "err", err)
+	}
+	if status, _, _, _ := classifyError(err); status == http.StatusInternalServerError {
+		slog.ErrorContext(r.Context(), "Payment failed", "err", err)
+		writeProblem(w, r, http.StatusBadGateway, "payment_failed", "Payment failed")
+		return
+	}
+	writeError(w, r, err)
 }
@@ -0,0 +1,130 @@
+package microServerMainFiles
+
+import (
+	"context"
+	"errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+// maxCartMergeAttempts bounds how often AddItem retries when a concurrent
+// add creates the cart or the line between its steps
+const maxCartMergeAttempts = 3
+
+// MongoCartRepository stores carts in the carts collection
+type MongoCartRepository struct {
+	collection *mongo.Collection
+}
+
+// NewMongoCartRepository returns a CartRepository backed by the carts
+// collection of database
+func NewMongoCartRepository(database *mongo.Database) *MongoCartRepository {
+	return &MongoCartRepository{collection: database.Collection("carts")}
+}
+
+func (r *MongoCartRepository) Get(ctx context.Context, userID string) (*Cart, error) {
+	var cart Cart
+	err := r.collection.FindOne(ctx, bson.M{"user_id": userID}).Decode(&cart)
+	if err == mongo.ErrNoDocuments {
+		return &Cart{UserID: userID, Items: []CartItem{}}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &cart, nil
+}
+
+func (r *MongoCartRepository) AddItem(ctx context.Context, userID string, item CartItem) (bool, error) {
+	for attempt := 0; attempt < maxCartMergeAttempts; attempt++ {
+		// Merge into an existing line for this product
+		result, err := r.collection.UpdateOne(
+			ctx,
+			bson.M{"user_id": userID, "items.product_id": item.ProductID},
+			bson.M{
+				"$inc": bson.M{"items.$.quantity": item.Quantity},
+				"$set": bson.M{"items.$.price": item.Price, "updated_at": time.Now()},
+			},
+		)
+		if err != nil {
+			return false, err
+		}
+		if result.MatchedCount > 0 {
+			return false, nil
+		}
+
+		// Append a new line to a cart that doesn't have this product yet
+		result, err = r.collection.UpdateOne(
+			ctx,
+			bson.M{"user_id": userID, "items.product_id": bson.M{"$ne": item.ProductID}},
+			bson.M{
+				"$push": bson.M{"items": item},
+				"$set":  bson.M{"updated_at": time.Now()},
+			},
+		)
+		if err != nil {
+			return false, err
+		}
+		if result.MatchedCount > 0 {
+			return false, nil
+		}
+
+		// No cart at all: create it with just this line
+		result, err = r.collection.UpdateOne(
+			ctx,
+			bson.M{"user_id": userID},
+			bson.M{"$setOnInsert": bson.M{"items": []CartItem{item}, "updated_at": time.Now()}},
+			options.Update().SetUpsert(true),
+		)
+		if err != nil {
+			return false, err
+		}
+		if result.UpsertedCount > 0 {
+			return true, nil
+		}
+	}
+	return false, errors.New("cart changed concurrently, please retry")
+}
+
+func (r *MongoCartRepository) SetItemQuantity(ctx context.Context, userID, productID string, quantity int) error {
+	result, err := r.collection.UpdateOne(
+		ctx,
+		bson.M{"user_id": userID, "items.product_id": productID},
+		bson.M{"$set": bson.M{"items.$.quantity": quantity, "updated_at": time.Now()}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *MongoCartRepository) RemoveItem(ctx context.Context, userID, productID string) error {
+	result, err := r.collection.UpdateOne(
+		ctx,
+		bson.M{"user_id": userID, "items.product_id": productID},
+		bson.M{
+			"$pull": bson.M{"items": bson.M{"product_id": productID}},
+			"$set":  bson.M{"updated_at": time.Now()},
+		},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *MongoCartRepository) Clear(ctx context.Context, userID string) error {
+	_, err := r.collection.UpdateOne(
+		ctx,
+		bson.M{"user_id": userID},
+		bson.M{"$set": bson.M{"items": []CartItem{}, "updated_at": time.Now()}},
+	)
+	return err
+}
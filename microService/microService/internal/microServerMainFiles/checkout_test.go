@@ -0,0 +1,153 @@
+package microServerMainFiles
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const concurrentCheckouts = 20
+
+// yieldingCarts pauses after reading a cart, so that unless something
+// serializes them, concurrent checkouts all read the cart before any of
+// them clears it
+type yieldingCarts struct {
+	CartRepository
+}
+
+func (c yieldingCarts) Get(ctx context.Context, userID string) (*Cart, error) {
+	cart, err := c.CartRepository.Get(ctx, userID)
+	time.Sleep(time.Millisecond)
+	return cart, err
+}
+
+// checkOutConcurrently checks out one cart from many goroutines at once and
+// expects exactly one of them to create a transaction and reserve stock
+func checkOutConcurrently(t *testing.T) {
+	t.Helper()
+	carts = yieldingCarts{carts}
+	ctx := context.Background()
+	const userID = "racer@example.com"
+	stock, reserved := productStock(t, "1")
+	if _, err := carts.AddItem(ctx, userID, CartItem{ProductID: "1", Quantity: 2, Price: 110}); err != nil {
+		t.Fatalf("carts.AddItem() error = %v", err)
+	}
+
+	start := make(chan struct{})
+	errs := make([]error, concurrentCheckouts)
+	var wg sync.WaitGroup
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			_, errs[i] = CreateTransactionFromCart(ctx, userID)
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	created := 0
+	for _, err := range errs {
+		switch {
+		case err == nil:
+			created++
+		case !errors.Is(err, ErrEmptyCart):
+			t.Errorf("CreateTransactionFromCart() error = %v, want nil or ErrEmptyCart", err)
+		}
+	}
+	if created != 1 {
+		t.Errorf("%d of %d concurrent checkouts succeeded, want 1", created, concurrentCheckouts)
+	}
+
+	list, err := transactions.ListByUser(ctx, userID)
+	if err != nil {
+		t.Fatalf("transactions.ListByUser() error = %v", err)
+	}
+	if len(list) != 1 {
+		t.Errorf("%d transactions created, want 1", len(list))
+	}
+	if available, nowReserved := productStock(t, "1"); available != stock-2 || nowReserved != reserved+2 {
+		t.Errorf("stock = %d available, %d reserved; want %d, %d", available, nowReserved, stock-2, reserved+2)
+	}
+	cart, err := carts.Get(ctx, userID)
+	if err != nil {
+		t.Fatalf("carts.Get() error = %v", err)
+	}
+	if len(cart.Items) != 0 {
+		t.Errorf("cart has %d items after checkout, want 0", len(cart.Items))
+	}
+}
+
+func TestConcurrentCheckoutMemory(t *testing.T) {
+	SetRepositories(NewMemoryRepositories())
+	if err := InitProductCatalog(); err != nil {
+		t.Fatalf("InitProductCatalog() error = %v", err)
+	}
+	checkOutConcurrently(t)
+}
+
+// TestConcurrentCheckoutMongo runs against the MongoDB at MONGO_TEST_URI,
+// which must be a replica set as MongoTransactor needs transactions. Each
+// run uses its own database and drops it afterwards.
+func TestConcurrentCheckoutMongo(t *testing.T) {
+	uri := os.Getenv("MONGO_TEST_URI")
+	if uri == "" {
+		t.Skip("MONGO_TEST_URI is not set")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatalf("mongo.Connect() error = %v", err)
+	}
+	t.Cleanup(func() { client.Disconnect(context.Background()) })
+
+	var hello bson.M
+	if err := client.Database("admin").RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello); err != nil {
+		t.Fatalf("hello error = %v", err)
+	}
+	if _, ok := hello["setName"]; !ok {
+		t.Skip("MONGO_TEST_URI is not a replica set, so transactions are unavailable")
+	}
+
+	database := client.Database(fmt.Sprintf("microservice_test_%d", time.Now().UnixNano()))
+	t.Cleanup(func() { database.Drop(context.Background()) })
+
+	SetRepositories(NewMongoRepositories(database, database))
+	if err := InitProductCatalog(); err != nil {
+		t.Fatalf("InitProductCatalog() error = %v", err)
+	}
+	checkOutConcurrently(t)
+}
+
+// TestReserveStockReportsTotal checks that a product split over several
+// lines is reported with the total asked for, not the failing line's share
+func TestReserveStockReportsTotal(t *testing.T) {
+	SetRepositories(NewMemoryRepositories())
+	if err := InitProductCatalog(); err != nil {
+		t.Fatalf("InitProductCatalog() error = %v", err)
+	}
+	stock, reserved := productStock(t, "1")
+	items := []CartItem{{ProductID: "1", Quantity: stock}, {ProductID: "1", Quantity: 1}}
+
+	var stockErr *InsufficientStockError
+	if err := products.ReserveStock(context.Background(), items); !errors.As(err, &stockErr) {
+		t.Fatalf("ReserveStock() error = %v, want an InsufficientStockError", err)
+	}
+	if stockErr.ProductID != "1" || stockErr.Requested != stock+1 {
+		t.Errorf("error = %+v, want product 1 with %d requested", stockErr, stock+1)
+	}
+	if available, nowReserved := productStock(t, "1"); available != stock || nowReserved != reserved {
+		t.Errorf("stock = %d available, %d reserved; want it unchanged: %d, %d", available, nowReserved, stock, reserved)
+	}
+}
@@ -1,9 +1,50 @@
 package microServerMainFiles
 
-import "go.mongodb.org/mongo-driver/mongo"
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/mongo"
+)
 
-var db *mongo.Database
+// NewMongoRepositories returns repositories backed by database, with users
+// kept in authDatabase
+func NewMongoRepositories(database, authDatabase *mongo.Database) Repositories {
+	return Repositories{
+		Users:           NewMongoUserRepository(authDatabase),
+		Products:        NewMongoProductRepository(database),
+		Carts:           NewMongoCartRepository(database),
+		Transactions:    NewMongoTransactionRepository(database),
+		Audit:           NewMongoAuditLog(database),
+		PasswordResets:  NewMongoPasswordResetRepository(database),
+		RefreshTokens:   NewMongoRefreshTokenRepository(database),
+		RevokedTokens:   NewMongoRevokedTokenRepository(database),
+		IdempotencyKeys: NewMongoIdempotencyKeyRepository(database),
+		Transactor:      NewMongoTransactor(database.Client()),
+	}
+}
+
+// MongoTransactor runs functions in a MongoDB multi-document transaction,
+// which needs a replica set
+type MongoTransactor struct {
+	client *mongo.Client
+}
+
+// NewMongoTransactor returns a Transactor that starts sessions on client
+func NewMongoTransactor(client *mongo.Client) *MongoTransactor {
+	return &MongoTransactor{client: client}
+}
+
+// WithTransaction runs fn in a transaction. The driver retries fn on
+// transient errors such as write conflicts, so fn must build everything from
+// scratch each time it is called.
+func (t *MongoTransactor) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	session, err := t.client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
 
-func SetDatabase(database *mongo.Database) {
-	db = database
+	_, err = session.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sessCtx)
+	})
+	return err
 }
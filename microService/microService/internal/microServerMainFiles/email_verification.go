@@ -0,0 +1,99 @@
+package microServerMainFiles
+
+import (
+	"context"
+	"log/slog"
+	"microService/pkg/email"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// verificationTokenTTL is how long the link emailed at signup works
+const verificationTokenTTL = 24 * time.Hour
+
+var (
+	// errInvalidVerificationToken covers unknown, expired and already used
+	// tokens alike
+	errInvalidVerificationToken = Validation("invalid_verification_token", "This verification link is invalid or has expired", FieldError{Field: "token", Message: "is invalid or has expired"})
+	errEmailUnverified          = Forbidden("email_unverified", "Verify your email address before checking out")
+)
+
+// SendVerificationEmail emails the user with address a link that verifies
+// it. A new link replaces any earlier one.
+func SendVerificationEmail(ctx context.Context, address string) error {
+	token, err := newSecureToken()
+	if err != nil {
+		return err
+	}
+	if err := users.SetVerificationToken(ctx, address, hashToken(token), time.Now().Add(verificationTokenTTL)); err != nil {
+		return err
+	}
+
+	link := publicURL + "/verify?token=" + url.QueryEscape(token)
+	body := "Welcome! Open this link within " + verificationTokenTTL.String() +
+		" to verify your email address:\n\n" + link +
+		"\n\nIf you didn't sign up, ignore this email."
+	return email.SendEmail(address, "Verify your email address", body)
+}
+
+// sendVerificationInBackground sends the verification email after the
+// response, logging rather than returning failures
+func sendVerificationInBackground(ctx context.Context, address string) {
+	ctx = context.WithoutCancel(ctx)
+	runInBackground(func() {
+		if err := SendVerificationEmail(ctx, address); err != nil {
+			slog.ErrorContext(ctx, "Failed to send verification email", "err", err)
+		}
+	})
+}
+
+// VerifyEmailHandler handles /verify?token=..., the link in the
+// verification email. A GET, from following the link, is redirected to the
+// login page; a POST is answered with 204.
+func VerifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, r)
+		return
+	}
+
+	address, err := users.VerifyEmail(r.Context(), hashToken(r.URL.Query().Get("token")), time.Now())
+	if err == ErrNotFound {
+		err = errInvalidVerificationToken
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	sessionUsers.forget(address)
+	slog.InfoContext(r.Context(), "Email verified", "user", address)
+	if r.Method == http.MethodGet {
+		http.Redirect(w, r, "/login.html?verified=1", http.StatusSeeOther)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ResendVerification handles POST /api/account/verification, which emails
+// the caller a new verification link
+func ResendVerification(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, r)
+		return
+	}
+
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		slog.WarnContext(r.Context(), "User ID not found in context")
+		writeError(w, r, errNoUser)
+		return
+	}
+	if isEmailVerified(r) {
+		writeError(w, r, Conflict("already_verified", "Email address is already verified"))
+		return
+	}
+
+	sendVerificationInBackground(r.Context(), userID)
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,183 @@
+package microServerMainFiles
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	paymentpkg "microService/pkg/payment"
+	"net/http"
+)
+
+// ErrorKind classifies a domain error by how the client should react to it,
+// which decides the status code it is answered with
+type ErrorKind int
+
+const (
+	KindValidation ErrorKind = iota + 1
+	KindUnauthorized
+	KindForbidden
+	KindNotFound
+	KindConflict
+)
+
+// status returns the HTTP status code errors of kind k are answered with
+func (k ErrorKind) status() int {
+	switch k {
+	case KindValidation:
+		return http.StatusBadRequest
+	case KindUnauthorized:
+		return http.StatusUnauthorized
+	case KindForbidden:
+		return http.StatusForbidden
+	case KindNotFound:
+		return http.StatusNotFound
+	case KindConflict:
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// FieldError explains what is wrong with one field of a request
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Error is a failure the client caused or can act on. Code is a stable,
+// machine readable identifier such as "cart_empty"; Message is shown to
+// people. Err, if set, is the underlying cause and is never sent to the
+// client.
+type Error struct {
+	Kind    ErrorKind
+	Code    string
+	Message string
+	Fields  []FieldError
+	Err     error
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// NotFound returns an error for a resource that does not exist
+func NotFound(code, message string) *Error {
+	return &Error{Kind: KindNotFound, Code: code, Message: message}
+}
+
+// Conflict returns an error for a request that clashes with the current
+// state of a resource
+func Conflict(code, message string) *Error {
+	return &Error{Kind: KindConflict, Code: code, Message: message}
+}
+
+// Validation returns an error for a malformed request, optionally listing
+// the fields at fault
+func Validation(code, message string, fields ...FieldError) *Error {
+	return &Error{Kind: KindValidation, Code: code, Message: message, Fields: fields}
+}
+
+// Unauthorized returns an error for a request without valid credentials
+func Unauthorized(code, message string) *Error {
+	return &Error{Kind: KindUnauthorized, Code: code, Message: message}
+}
+
+// Forbidden returns an error for a caller that is not allowed to do this
+func Forbidden(code, message string) *Error {
+	return &Error{Kind: KindForbidden, Code: code, Message: message}
+}
+
+// Errors shared by many handlers
+var (
+	errInvalidBody   = Validation("invalid_body", "Invalid request")
+	errNoUser        = Unauthorized("unauthenticated", "User ID not found in context")
+	errAdminRequired = Forbidden("admin_required", "Admin role required")
+)
+
+// Problem is an RFC 7807 problem details body. Code and Errors are
+// extensions: a machine readable error code and the fields at fault.
+type Problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail,omitempty"`
+	Instance  string       `json:"instance,omitempty"`
+	Code      string       `json:"code"`
+	Errors    []FieldError `json:"errors,omitempty"`
+	RequestID string       `json:"request_id,omitempty"`
+}
+
+// writeError answers r with the problem err maps to. Errors that don't map
+// to a client error are logged and answered with a generic 500 so their
+// text never reaches the client.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	status, code, detail, fields := classifyError(err)
+	if status == http.StatusInternalServerError {
+		slog.ErrorContext(r.Context(), "Request failed", "err", err)
+	}
+	writeProblem(w, r, status, code, detail, fields...)
+}
+
+// classifyError maps err to a status code, error code, message and field
+// errors. Domain errors carry their own; errors from the layers below are
+// mapped here so handlers don't each have to.
+func classifyError(err error) (int, string, string, []FieldError) {
+	var domain *Error
+	var illegal *IllegalTransitionError
+	var stock *InsufficientStockError
+	var refundLine *RefundLineError
+	var card *paymentpkg.CardError
+	switch {
+	case errors.As(err, &domain):
+		return domain.Kind.status(), domain.Code, domain.Message, domain.Fields
+	case errors.As(err, &illegal):
+		return http.StatusConflict, "illegal_transition", "Transaction is " + string(illegal.From) + " and cannot become " + string(illegal.To), nil
+	case errors.As(err, &stock):
+		return http.StatusConflict, "insufficient_stock", "Insufficient stock for product " + stock.ProductID, nil
+	case errors.As(err, &refundLine):
+		return http.StatusBadRequest, "invalid_refund", "Invalid refund", []FieldError{{Field: "items", Message: refundLine.Error()}}
+	case errors.As(err, &card):
+		return http.StatusBadRequest, "invalid_card", "Invalid card", []FieldError{{Field: card.Field, Message: card.Message}}
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound, "not_found", "Not found", nil
+	case errors.Is(err, ErrDuplicate):
+		return http.StatusConflict, "duplicate", "Already exists", nil
+	case errors.Is(err, paymentpkg.ErrInsufficientFunds):
+		return http.StatusPaymentRequired, "insufficient_funds", "Payment declined: insufficient funds", nil
+	case paymentpkg.IsDecline(err):
+		return http.StatusPaymentRequired, "payment_declined", "Payment declined", nil
+	case errors.Is(err, paymentpkg.ErrTimeout), errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, "gateway_timeout", "Payment gateway timed out, please try again", nil
+	}
+	return http.StatusInternalServerError, "internal_error", "Something went wrong, please try again later", nil
+}
+
+// writeProblem writes an application/problem+json response
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, code, detail string, fields ...FieldError) {
+	problem := Problem{
+		Type:      "about:blank",
+		Title:     http.StatusText(status),
+		Status:    status,
+		Detail:    detail,
+		Instance:  r.URL.Path,
+		Code:      code,
+		Errors:    fields,
+		RequestID: w.Header().Get("X-Request-ID"),
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(problem)
+}
+
+// writeMethodNotAllowed answers a request made with an unsupported method
+func writeMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeProblem(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "Invalid request method")
+}
@@ -0,0 +1,467 @@
+package microServerMainFiles
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"microService/pkg/email"
+	"microService/pkg/payment"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testPassword = "Plenty-of-entropy-42"
+
+var mailbox *fakeSMTP
+
+func TestMain(m *testing.M) {
+	// Receipts load their font relative to the module root, which is where
+	// the server runs from
+	if err := os.Chdir("../.."); err != nil {
+		fmt.Fprintln(os.Stderr, "chdir to module root:", err)
+		os.Exit(1)
+	}
+
+	var err error
+	mailbox, err = startFakeSMTP()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "start fake SMTP server:", err)
+		os.Exit(1)
+	}
+	email.Configure(email.Config{Host: "127.0.0.1", Port: mailbox.port(), From: "shop@example.com"})
+	SetJWTConfig([]byte("test-signing-key-that-is-long-enough"), 15*time.Minute, 24*time.Hour)
+
+	code := m.Run()
+	mailbox.close()
+	os.Exit(code)
+}
+
+// fakeSMTP accepts every message sent to it and keeps them for tests to read
+type fakeSMTP struct {
+	listener net.Listener
+	mu       sync.Mutex
+	messages []smtpMessage
+}
+
+type smtpMessage struct {
+	to   []string
+	data string
+}
+
+func startFakeSMTP() (*fakeSMTP, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &fakeSMTP{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s, nil
+}
+
+func (s *fakeSMTP) port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *fakeSMTP) close() {
+	s.listener.Close()
+}
+
+// serve speaks just enough SMTP for net/smtp and gomail. AUTH is advertised
+// and accepted because smtp.SendMail refuses servers without it.
+func (s *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reply := func(lines ...string) {
+		for _, line := range lines {
+			fmt.Fprintf(conn, "%s\r\n", line)
+		}
+	}
+
+	reply("220 localhost fake SMTP")
+	var message smtpMessage
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		command := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+			reply("250-localhost", "250 AUTH PLAIN")
+		case strings.HasPrefix(command, "AUTH"):
+			reply("235 Authenticated")
+		case strings.HasPrefix(command, "MAIL FROM:"):
+			message = smtpMessage{}
+			reply("250 OK")
+		case strings.HasPrefix(command, "RCPT TO:"):
+			message.to = append(message.to, strings.Trim(line[len("RCPT TO:"):], " <>"))
+			reply("250 OK")
+		case command == "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			var data strings.Builder
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			message.data = data.String()
+			s.mu.Lock()
+			s.messages = append(s.messages, message)
+			s.mu.Unlock()
+			reply("250 OK")
+		case command == "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+// reset forgets every message sent so far
+func (s *fakeSMTP) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = nil
+}
+
+// sentTo returns the messages sent to address so far
+func (s *fakeSMTP) sentTo(address string) []smtpMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var sent []smtpMessage
+	for _, message := range s.messages {
+		for _, to := range message.to {
+			if to == address {
+				sent = append(sent, message)
+			}
+		}
+	}
+	return sent
+}
+
+// newTestServer serves the shop's handlers over fresh in-memory
+// repositories, routed as in cmd/server, with an empty mailbox
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	mailbox.reset()
+	SetRepositories(NewMemoryRepositories())
+	SetPaymentGateway(payment.NewSimulator())
+	if err := InitProductCatalog(); err != nil {
+		t.Fatalf("InitProductCatalog() error = %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/signup", http.HandlerFunc(SignUp))
+	mux.Handle("/login", http.HandlerFunc(Login))
+	mux.Handle("/verify", http.HandlerFunc(VerifyEmailHandler))
+	mux.Handle("/api/cart/add", JWTMiddleware(http.HandlerFunc(AddProductToCart)))
+	mux.Handle("/api/cart", JWTMiddleware(http.HandlerFunc(GetCart)))
+	mux.Handle("/api/transaction/checkout", JWTMiddleware(IdempotencyMiddleware(http.HandlerFunc(Checkout))))
+	mux.Handle("/api/transaction/pay", JWTMiddleware(IdempotencyMiddleware(http.HandlerFunc(ProcessPayment))))
+	mux.Handle("/api/transaction/pending", JWTMiddleware(http.HandlerFunc(GetPendingTransaction)))
+	mux.Handle("/api/transactions", JWTMiddleware(http.HandlerFunc(GetTransactions)))
+	mux.Handle("/api/transactions/", JWTMiddleware(http.HandlerFunc(TransactionAction)))
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(func() {
+		server.Close()
+		WaitForBackgroundJobs(context.Background())
+	})
+	return server
+}
+
+// testClient calls a test server as one user
+type testClient struct {
+	t      *testing.T
+	server *httptest.Server
+	token  string
+}
+
+// do sends body as JSON and returns the response, failing the test if the
+// request can't be made
+func (c *testClient) do(method, path string, body interface{}, header http.Header) *http.Response {
+	c.t.Helper()
+	var reader bytes.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			c.t.Fatalf("encode %s %s: %v", method, path, err)
+		}
+		reader = *bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequest(method, c.server.URL+path, &reader)
+	if err != nil {
+		c.t.Fatalf("new request %s %s: %v", method, path, err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.server.Client().Do(req)
+	if err != nil {
+		c.t.Fatalf("%s %s: %v", method, path, err)
+	}
+	c.t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// expect checks the response status and decodes its body into v, if given
+func (c *testClient) expect(resp *http.Response, status int, v interface{}) {
+	c.t.Helper()
+	if resp.StatusCode != status {
+		var problem bytes.Buffer
+		problem.ReadFrom(resp.Body)
+		c.t.Fatalf("%s %s = %d, want %d: %s", resp.Request.Method, resp.Request.URL.Path, resp.StatusCode, status, problem.String())
+	}
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			c.t.Fatalf("decode %s %s: %v", resp.Request.Method, resp.Request.URL.Path, err)
+		}
+	}
+}
+
+// expectProblem checks the response is a problem with status and code
+func (c *testClient) expectProblem(resp *http.Response, status int, code string) {
+	c.t.Helper()
+	var problem Problem
+	c.expect(resp, status, &problem)
+	if problem.Code != code {
+		c.t.Fatalf("%s %s code = %q, want %q", resp.Request.Method, resp.Request.URL.Path, problem.Code, code)
+	}
+}
+
+var verificationLink = regexp.MustCompile(`/verify\?token=([A-Za-z0-9_-]+)`)
+
+// signUp registers address and logs in, following the emailed verification
+// link first if verify is set
+func signUp(t *testing.T, server *httptest.Server, address string, verify bool) *testClient {
+	t.Helper()
+	c := &testClient{t: t, server: server}
+	credentials := map[string]string{"email": address, "password": testPassword}
+	c.expect(c.do(http.MethodPost, "/signup", credentials, nil), http.StatusOK, nil)
+
+	if verify {
+		if err := WaitForBackgroundJobs(context.Background()); err != nil {
+			t.Fatalf("WaitForBackgroundJobs() error = %v", err)
+		}
+		sent := mailbox.sentTo(address)
+		if len(sent) != 1 {
+			t.Fatalf("%d emails sent to %s after signup, want 1", len(sent), address)
+		}
+		match := verificationLink.FindStringSubmatch(sent[0].data)
+		if match == nil {
+			t.Fatalf("verification email has no link:\n%s", sent[0].data)
+		}
+		c.expect(c.do(http.MethodPost, "/verify?token="+match[1], nil, nil), http.StatusNoContent, nil)
+	}
+
+	var pair TokenPair
+	c.expect(c.do(http.MethodPost, "/login", credentials, nil), http.StatusOK, &pair)
+	c.token = pair.AccessToken
+	return c
+}
+
+// productStock returns the available and reserved stock of a product
+func productStock(t *testing.T, productID string) (int, int) {
+	t.Helper()
+	product, err := products.Get(context.Background(), productID)
+	if err != nil {
+		t.Fatalf("products.Get(%q) error = %v", productID, err)
+	}
+	return product.Stock, product.Reserved
+}
+
+// paymentResponse is the body of a successful payment
+type paymentResponse struct {
+	Redirect    string      `json:"redirect"`
+	Transaction Transaction `json:"transaction"`
+}
+
+var approvedCard = PaymentForm{
+	CardNumber:     payment.TestCardApproved,
+	ExpirationDate: "12/99",
+	CVV:            "123",
+	Name:           "Test Buyer",
+}
+
+func TestSignUpCheckoutAndPay(t *testing.T) {
+	server := newTestServer(t)
+	buyer := signUp(t, server, "buyer@example.com", true)
+	stock, _ := productStock(t, "1")
+
+	// The client's price is ignored in favour of the catalog's
+	buyer.expect(buyer.do(http.MethodPost, "/api/cart/add", CartItem{ProductID: "1", Quantity: 2, Price: 0.01}, nil), http.StatusOK, nil)
+	var cart Cart
+	buyer.expect(buyer.do(http.MethodGet, "/api/cart", nil, nil), http.StatusOK, &cart)
+	if len(cart.Items) != 1 || cart.Items[0].Quantity != 2 || cart.Items[0].Price != 110 {
+		t.Fatalf("cart items = %+v, want 2 of product 1 at 110", cart.Items)
+	}
+
+	var transaction Transaction
+	buyer.expect(buyer.do(http.MethodPost, "/api/transaction/checkout", nil, nil), http.StatusOK, &transaction)
+	if transaction.Status != StatusPending || transaction.TotalAmount != 220 || !transaction.StockReserved {
+		t.Fatalf("checkout = %s for %.2f (stock reserved %v), want pending for 220.00 with stock reserved", transaction.Status, transaction.TotalAmount, transaction.StockReserved)
+	}
+	if available, reserved := productStock(t, "1"); available != stock-2 || reserved != 2 {
+		t.Fatalf("after checkout stock = %d available, %d reserved; want %d, 2", available, reserved, stock-2)
+	}
+	buyer.expect(buyer.do(http.MethodGet, "/api/cart", nil, nil), http.StatusOK, &cart)
+	if len(cart.Items) != 0 {
+		t.Fatalf("cart after checkout has %d items, want 0", len(cart.Items))
+	}
+
+	var paid paymentResponse
+	buyer.expect(buyer.do(http.MethodPost, "/api/transaction/pay", approvedCard, nil), http.StatusOK, &paid)
+	if paid.Redirect != "/cart.html" || paid.Transaction.ID != transaction.ID || paid.Transaction.Status != StatusPaid {
+		t.Fatalf("pay = %+v, want the paid transaction and a redirect to the cart", paid)
+	}
+
+	var list []Transaction
+	buyer.expect(buyer.do(http.MethodGet, "/api/transactions", nil, nil), http.StatusOK, &list)
+	if len(list) != 1 || list[0].Status != StatusPaid || list[0].PaymentID == "" {
+		t.Fatalf("transactions = %+v, want one paid transaction with a payment ID", list)
+	}
+	if list[0].PaymentMethod == nil || list[0].PaymentMethod.Last4 != "4242" {
+		t.Errorf("payment method = %v, want the card ending in 4242", list[0].PaymentMethod)
+	}
+	if available, reserved := productStock(t, "1"); available != stock-2 || reserved != 0 {
+		t.Errorf("after payment stock = %d available, %d reserved; want %d, 0", available, reserved, stock-2)
+	}
+	if err := WaitForBackgroundJobs(context.Background()); err != nil {
+		t.Fatalf("WaitForBackgroundJobs() error = %v", err)
+	}
+	if sent := mailbox.sentTo("buyer@example.com"); len(sent) != 2 || !strings.Contains(sent[1].data, "receipt.pdf") {
+		t.Errorf("%d emails sent to the buyer, want the verification email and a receipt", len(sent))
+	}
+	buyer.expectProblem(buyer.do(http.MethodGet, "/api/transaction/pending", nil, nil), http.StatusNotFound, "no_pending_transaction")
+}
+
+func TestCheckoutRequiresVerifiedEmail(t *testing.T) {
+	server := newTestServer(t)
+	buyer := signUp(t, server, "unverified@example.com", false)
+
+	buyer.expect(buyer.do(http.MethodPost, "/api/cart/add", CartItem{ProductID: "2", Quantity: 1}, nil), http.StatusOK, nil)
+	buyer.expectProblem(buyer.do(http.MethodPost, "/api/transaction/checkout", nil, nil), http.StatusForbidden, "email_unverified")
+	buyer.expectProblem(buyer.do(http.MethodPost, "/api/transaction/pay", approvedCard, nil), http.StatusForbidden, "email_unverified")
+}
+
+func TestCheckoutEmptyCart(t *testing.T) {
+	server := newTestServer(t)
+	buyer := signUp(t, server, "empty@example.com", true)
+
+	buyer.expectProblem(buyer.do(http.MethodPost, "/api/transaction/checkout", nil, nil), http.StatusConflict, "cart_empty")
+}
+
+func TestCheckoutRequiresToken(t *testing.T) {
+	server := newTestServer(t)
+	anonymous := &testClient{t: t, server: server}
+
+	anonymous.expectProblem(anonymous.do(http.MethodPost, "/api/transaction/checkout", nil, nil), http.StatusUnauthorized, "missing_token")
+	anonymous.token = "not-a-jwt"
+	anonymous.expectProblem(anonymous.do(http.MethodPost, "/api/transaction/checkout", nil, nil), http.StatusUnauthorized, "invalid_token")
+}
+
+func TestPayDeclinedThenApproved(t *testing.T) {
+	server := newTestServer(t)
+	buyer := signUp(t, server, "declined@example.com", true)
+	stock, _ := productStock(t, "3")
+
+	buyer.expect(buyer.do(http.MethodPost, "/api/cart/add", CartItem{ProductID: "3", Quantity: 1}, nil), http.StatusOK, nil)
+	buyer.expect(buyer.do(http.MethodPost, "/api/transaction/checkout", nil, nil), http.StatusOK, nil)
+
+	tests := []struct {
+		card   string
+		status int
+		code   string
+	}{
+		{payment.TestCardDeclined, http.StatusPaymentRequired, "payment_declined"},
+		{payment.TestCardInsufficientFunds, http.StatusPaymentRequired, "insufficient_funds"},
+		{"4242424242424241", http.StatusBadRequest, "invalid_card"},
+	}
+	for _, tt := range tests {
+		card := approvedCard
+		card.CardNumber = tt.card
+		buyer.expectProblem(buyer.do(http.MethodPost, "/api/transaction/pay", card, nil), tt.status, tt.code)
+
+		// A failed payment leaves the transaction pending for another card
+		var pending Transaction
+		buyer.expect(buyer.do(http.MethodGet, "/api/transaction/pending", nil, nil), http.StatusOK, &pending)
+		if pending.Status != StatusPending {
+			t.Fatalf("after paying with %s the transaction is %s, want pending", tt.card, pending.Status)
+		}
+	}
+
+	buyer.expect(buyer.do(http.MethodPost, "/api/transaction/pay", approvedCard, nil), http.StatusOK, nil)
+	if available, reserved := productStock(t, "3"); available != stock-1 || reserved != 0 {
+		t.Errorf("after payment stock = %d available, %d reserved; want %d, 0", available, reserved, stock-1)
+	}
+}
+
+func TestIdempotentCheckout(t *testing.T) {
+	server := newTestServer(t)
+	buyer := signUp(t, server, "retry@example.com", true)
+	key := http.Header{"Idempotency-Key": {"checkout-1"}}
+
+	buyer.expect(buyer.do(http.MethodPost, "/api/cart/add", CartItem{ProductID: "2", Quantity: 3}, nil), http.StatusOK, nil)
+	var first, replayed Transaction
+	buyer.expect(buyer.do(http.MethodPost, "/api/transaction/checkout", nil, key), http.StatusOK, &first)
+	buyer.expect(buyer.do(http.MethodPost, "/api/transaction/checkout", nil, key), http.StatusOK, &replayed)
+	if replayed.ID != first.ID {
+		t.Fatalf("replayed checkout returned transaction %s, want %s", replayed.ID.Hex(), first.ID.Hex())
+	}
+
+	var list []Transaction
+	buyer.expect(buyer.do(http.MethodGet, "/api/transactions", nil, nil), http.StatusOK, &list)
+	if len(list) != 1 {
+		t.Fatalf("%d transactions after a retried checkout, want 1", len(list))
+	}
+}
+
+func TestPayWhenReceiptFails(t *testing.T) {
+	server := newTestServer(t)
+	buyer := signUp(t, server, "noreceipt@example.com", true)
+	buyer.expect(buyer.do(http.MethodPost, "/api/cart/add", CartItem{ProductID: "2", Quantity: 1}, nil), http.StatusOK, nil)
+	buyer.expect(buyer.do(http.MethodPost, "/api/transaction/checkout", nil, nil), http.StatusOK, nil)
+
+	// Nothing listens on port 1, so the receipt email can't be sent
+	email.Configure(email.Config{Host: "127.0.0.1", Port: 1, From: "shop@example.com"})
+	defer email.Configure(email.Config{Host: "127.0.0.1", Port: mailbox.port(), From: "shop@example.com"})
+
+	var paid paymentResponse
+	buyer.expect(buyer.do(http.MethodPost, "/api/transaction/pay", approvedCard, nil), http.StatusOK, &paid)
+	if paid.Transaction.Status != StatusPaid {
+		t.Fatalf("pay returned a %s transaction, want paid", paid.Transaction.Status)
+	}
+	if err := WaitForBackgroundJobs(context.Background()); err != nil {
+		t.Fatalf("WaitForBackgroundJobs() error = %v", err)
+	}
+	if sent := mailbox.sentTo("noreceipt@example.com"); len(sent) != 1 {
+		t.Errorf("%d emails sent to the buyer, want only the verification email", len(sent))
+	}
+}
@@ -0,0 +1,102 @@
+package microServerMainFiles
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// readinessCheckTimeout bounds each dependency check made by Readyz
+const readinessCheckTimeout = 2 * time.Second
+
+// ReadinessCheck reports whether a dependency can be used, returning nil if so
+type ReadinessCheck func(ctx context.Context) error
+
+var (
+	readinessChecks map[string]ReadinessCheck
+	draining        atomic.Bool
+)
+
+// SetReadinessChecks sets the dependencies Readyz checks, keyed by the name
+// they are reported under
+func SetReadinessChecks(checks map[string]ReadinessCheck) {
+	readinessChecks = checks
+}
+
+// StartDraining makes Readyz report not ready so load balancers stop
+// sending new requests before the server shuts down
+func StartDraining() {
+	draining.Store(true)
+}
+
+// dependencyStatus is one entry in the Readyz response. It carries no error
+// detail, as Readyz is unauthenticated; failures are logged instead.
+type dependencyStatus struct {
+	Status string `json:"status"`
+}
+
+type readinessResponse struct {
+	Status       string                      `json:"status"`
+	Dependencies map[string]dependencyStatus `json:"dependencies,omitempty"`
+}
+
+// Healthz reports that the process is up and serving requests. It checks
+// no dependencies, so a failing database doesn't get the process restarted.
+func Healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// Readyz reports whether the service can take traffic: every dependency
+// check passes and the server is not draining for shutdown. Checks run in
+// parallel, each with its own timeout, and each is reported as up or down
+// with the reason for a failure going to the log.
+func Readyz(w http.ResponseWriter, r *http.Request) {
+	if draining.Load() {
+		writeReadiness(w, http.StatusServiceUnavailable, readinessResponse{Status: "draining"})
+		return
+	}
+
+	response := readinessResponse{Status: "ready", Dependencies: make(map[string]dependencyStatus)}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range readinessChecks {
+		wg.Add(1)
+		go func(name string, check ReadinessCheck) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(r.Context(), readinessCheckTimeout)
+			defer cancel()
+
+			status := dependencyStatus{Status: "up"}
+			if err := check(ctx); err != nil {
+				slog.WarnContext(r.Context(), "Readiness check failed", "dependency", name, "err", err)
+				status = dependencyStatus{Status: "down"}
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			response.Dependencies[name] = status
+			if status.Status != "up" {
+				response.Status = "not_ready"
+			}
+		}(name, check)
+	}
+	wg.Wait()
+
+	statusCode := http.StatusOK
+	if response.Status != "ready" {
+		statusCode = http.StatusServiceUnavailable
+	}
+	writeReadiness(w, statusCode, response)
+}
+
+func writeReadiness(w http.ResponseWriter, statusCode int, response readinessResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,36 @@
+package microServerMainFiles
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReadyzHidesCheckErrors(t *testing.T) {
+	SetReadinessChecks(map[string]ReadinessCheck{
+		"mongo": func(ctx context.Context) error { return nil },
+		"smtp":  func(ctx context.Context) error { return errors.New("dial tcp 10.0.0.7:25: connection refused") },
+	})
+	t.Cleanup(func() { SetReadinessChecks(nil) })
+
+	rec := httptest.NewRecorder()
+	Readyz(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	if body := rec.Body.String(); strings.Contains(body, "10.0.0.7") || strings.Contains(body, "refused") {
+		t.Errorf("body %s leaks the check error", body)
+	}
+
+	var response readinessResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatalf("decoding the response: %v", err)
+	}
+	if response.Dependencies["mongo"].Status != "up" || response.Dependencies["smtp"].Status != "down" {
+		t.Errorf("dependencies = %+v, want mongo up and smtp down", response.Dependencies)
+	}
+}
@@ -0,0 +1,162 @@
+package microServerMainFiles
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// idempotencyWindow is how long a stored response is replayed for its key
+const idempotencyWindow = 24 * time.Hour
+
+// maxIdempotencyKeyLength bounds the header so keys can't be used to bloat
+// the collection
+const maxIdempotencyKeyLength = 255
+
+// IdempotencyRecord is a request seen with an Idempotency-Key and, once the
+// handler has finished, the response it produced
+type IdempotencyRecord struct {
+	UserID      string    `bson:"user_id"`
+	Key         string    `bson:"key"`
+	RequestHash string    `bson:"request_hash"`
+	Completed   bool      `bson:"completed"`
+	StatusCode  int       `bson:"status_code,omitempty"`
+	ContentType string    `bson:"content_type,omitempty"`
+	Body        []byte    `bson:"body,omitempty"`
+	CreatedAt   time.Time `bson:"created_at"`
+}
+
+// InitIdempotencyKeys creates the indexes for stored idempotency keys: one
+// record per user and key, removed once the window has passed
+func InitIdempotencyKeys() error {
+	err := idempotencyKeys.EnsureIndexes(context.TODO())
+	if err != nil {
+		slog.Error("Error creating idempotency key indexes", "err", err)
+	}
+	return err
+}
+
+// IdempotencyMiddleware makes requests carrying an Idempotency-Key header
+// safe to retry. The first request with a key runs normally and its response
+// is stored; repeats with the same key and the same method, path and body get
+// the stored response without running the handler again. Reusing a key for a
+// different request is rejected with 422, and a repeat that arrives while the
+// first is still running gets 409. Requests without the header are passed
+// through untouched. It must run inside JWTMiddleware, as keys are scoped
+// per user.
+func IdempotencyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			writeError(w, r, Validation("invalid_idempotency_key", "Idempotency-Key is too long"))
+			return
+		}
+
+		userID, ok := r.Context().Value("userID").(string)
+		if !ok {
+			slog.WarnContext(r.Context(), "User ID not found in context")
+			writeError(w, r, errNoUser)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, r, errInvalidBody)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		hash := sha256.New()
+		hash.Write([]byte(r.Method + " " + r.URL.Path + "\n"))
+		hash.Write(body)
+		requestHash := hex.EncodeToString(hash.Sum(nil))
+
+		// A record older than the window that hasn't been removed yet is
+		// replaced rather than replayed
+		now := time.Now()
+		claimed, err := idempotencyKeys.Claim(r.Context(), IdempotencyRecord{
+			UserID:      userID,
+			Key:         key,
+			RequestHash: requestHash,
+			CreatedAt:   now,
+		}, now.Add(-idempotencyWindow))
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		if !claimed {
+			existing, err := idempotencyKeys.Get(r.Context(), userID, key)
+			if err != nil {
+				writeError(w, r, err)
+				return
+			}
+			switch {
+			case existing.RequestHash != requestHash:
+				writeProblem(w, r, http.StatusUnprocessableEntity, "idempotency_key_reused", "Idempotency-Key was already used for a different request")
+			case !existing.Completed:
+				writeError(w, r, Conflict("idempotency_key_in_use", "A request with this Idempotency-Key is still in progress"))
+			default:
+				slog.InfoContext(r.Context(), "Replaying response for idempotency key")
+				if existing.ContentType != "" {
+					w.Header().Set("Content-Type", existing.ContentType)
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(existing.StatusCode)
+				w.Write(existing.Body)
+			}
+			return
+		}
+
+		// Whatever the handler produced is stored even if the client has gone
+		// away, so a retry gets it instead of running again
+		ctx := context.WithoutCancel(r.Context())
+		recorder := &responseRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		// Server errors are not cached so the client can retry with the same key
+		if recorder.statusCode >= http.StatusInternalServerError {
+			if err := idempotencyKeys.Release(ctx, userID, key); err != nil {
+				slog.ErrorContext(r.Context(), "Error releasing idempotency key", "err", err)
+			}
+			return
+		}
+
+		err = idempotencyKeys.Complete(ctx, userID, key, recorder.statusCode, recorder.Header().Get("Content-Type"), recorder.body.Bytes())
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error saving idempotent response", "err", err)
+		}
+	})
+}
+
+// responseRecorder passes a response through while keeping a copy of its
+// status and body
+type responseRecorder struct {
+	http.ResponseWriter
+	statusCode  int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(statusCode int) {
+	if !r.wroteHeader {
+		r.statusCode = statusCode
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
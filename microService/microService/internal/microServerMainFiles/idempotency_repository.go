@@ -0,0 +1,80 @@
+package microServerMainFiles
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+// MongoIdempotencyKeyRepository stores idempotency keys in the
+// idempotency_keys collection
+type MongoIdempotencyKeyRepository struct {
+	collection *mongo.Collection
+}
+
+// NewMongoIdempotencyKeyRepository returns an IdempotencyKeyRepository
+// backed by the idempotency_keys collection of database
+func NewMongoIdempotencyKeyRepository(database *mongo.Database) *MongoIdempotencyKeyRepository {
+	return &MongoIdempotencyKeyRepository{collection: database.Collection("idempotency_keys")}
+}
+
+// EnsureIndexes creates the unique index per user and key, and has MongoDB
+// remove records once the window has passed
+func (r *MongoIdempotencyKeyRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "key", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "created_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(int32(idempotencyWindow.Seconds())),
+		},
+	})
+	return err
+}
+
+// Claim relies on the unique index: of concurrent inserts for one key only
+// the first succeeds
+func (r *MongoIdempotencyKeyRepository) Claim(ctx context.Context, record IdempotencyRecord, staleBefore time.Time) (bool, error) {
+	_, err := r.collection.DeleteOne(ctx, bson.M{
+		"user_id":    record.UserID,
+		"key":        record.Key,
+		"created_at": bson.M{"$lt": staleBefore},
+	})
+	if err != nil {
+		return false, err
+	}
+
+	_, err = r.collection.InsertOne(ctx, record)
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (r *MongoIdempotencyKeyRepository) Get(ctx context.Context, userID, key string) (IdempotencyRecord, error) {
+	var record IdempotencyRecord
+	err := r.collection.FindOne(ctx, bson.M{"user_id": userID, "key": key}).Decode(&record)
+	return record, err
+}
+
+func (r *MongoIdempotencyKeyRepository) Complete(ctx context.Context, userID, key string, statusCode int, contentType string, body []byte) error {
+	_, err := r.collection.UpdateOne(ctx, bson.M{"user_id": userID, "key": key}, bson.M{"$set": bson.M{
+		"completed":    true,
+		"status_code":  statusCode,
+		"content_type": contentType,
+		"body":         body,
+	}})
+	return err
+}
+
+func (r *MongoIdempotencyKeyRepository) Release(ctx context.Context, userID, key string) error {
+	_, err := r.collection.DeleteOne(ctx, bson.M{"user_id": userID, "key": key})
+	return err
+}
@@ -0,0 +1,116 @@
+package microServerMainFiles
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// pendingTransactionTTL is how long checkout holds stock for a transaction
+// that has not been paid
+const pendingTransactionTTL = 15 * time.Minute
+
+// awaitingPaymentGrace is how much longer than its expiry a transaction
+// awaiting payment is kept. Its card is being charged, so it only expires
+// if the process died before the payment was settled, long after any call
+// to the gateway would have timed out.
+const awaitingPaymentGrace = 1 * time.Hour
+
+// InsufficientStockError is returned when a reservation asks for more units
+// of a product than are available
+type InsufficientStockError struct {
+	ProductID string
+	Requested int
+}
+
+func (e *InsufficientStockError) Error() string {
+	return fmt.Sprintf("insufficient stock for product %s (requested %d)", e.ProductID, e.Requested)
+}
+
+// ReserveStock moves the quantities in items from available to reserved
+// stock. It must run inside a Transactor: when a line fails the caller
+// aborts and the lines already reserved are rolled back with it.
+func ReserveStock(ctx context.Context, items []CartItem) error {
+	return products.ReserveStock(ctx, items)
+}
+
+// ReleaseStock returns reserved quantities to available stock
+func ReleaseStock(ctx context.Context, items []CartItem) error {
+	err := products.ReleaseStock(ctx, items)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error releasing stock", "err", err)
+	}
+	return err
+}
+
+// CommitStock consumes reserved quantities once they have been paid for
+func CommitStock(ctx context.Context, items []CartItem) error {
+	err := products.CommitStock(ctx, items)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error committing stock", "err", err)
+	}
+	return err
+}
+
+// RestockItems returns refunded quantities to available stock
+func RestockItems(ctx context.Context, items []CartItem) error {
+	err := products.Restock(ctx, items)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error restocking items", "err", err)
+	}
+	return err
+}
+
+// ExpirePendingTransactions marks pending transactions past their expiry,
+// and transactions left awaiting payment past awaitingPaymentGrace, as
+// expired and releases the stock they were holding
+func ExpirePendingTransactions(ctx context.Context) error {
+	expired, err := transactions.ListExpired(ctx, time.Now())
+	if err != nil {
+		slog.ErrorContext(ctx, "Error finding expired transactions", "err", err)
+		return err
+	}
+
+	for _, transaction := range expired {
+		// Only the caller that wins the transition releases the stock, so a
+		// payment racing with expiry can't both commit and release it
+		_, err := UpdateTransactionStatus(ctx, transaction.ID, StatusExpired, SystemActor)
+		var illegal *IllegalTransitionError
+		if errors.As(err, &illegal) {
+			continue
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "Error expiring transaction", "transaction_id", transaction.ID.Hex(), "err", err)
+			return err
+		}
+		if !transaction.StockReserved {
+			continue
+		}
+		if err := ReleaseStock(ctx, transaction.Items); err != nil {
+			return err
+		}
+		slog.InfoContext(ctx, "Expired transaction", "transaction_id", transaction.ID.Hex(), "user", transaction.UserID)
+	}
+	return nil
+}
+
+// StartTransactionExpiry runs ExpirePendingTransactions every interval until
+// ctx is cancelled
+func StartTransactionExpiry(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := ExpirePendingTransactions(context.WithoutCancel(ctx)); err != nil {
+					slog.ErrorContext(ctx, "Failed to expire pending transactions", "err", err)
+				}
+			}
+		}
+	}()
+}
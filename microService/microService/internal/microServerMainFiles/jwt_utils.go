@@ -3,24 +3,46 @@ package microServerMainFiles
 import (
 	"context"
 	"github.com/dgrijalva/jwt-go"
+	"log/slog"
 	"net/http"
 	"strings"
 	"time"
 )
 
-var jwtKey = []byte("hPLu7CdFd-CN0cFSKG6samteGUkBelvYymloCpyfDLI")
+var jwtKey []byte
+var jwtTTL = 15 * time.Minute
+var refreshTokenTTL = 30 * 24 * time.Hour
 
+// SetJWTConfig sets the HS256 signing key, the lifetime of access tokens
+// and that of the refresh tokens that renew them
+func SetJWTConfig(key []byte, ttl, refreshTTL time.Duration) {
+	jwtKey = key
+	jwtTTL = ttl
+	refreshTokenTTL = refreshTTL
+}
+
+// Claims are the contents of an access token. The standard jti claim (Id)
+// identifies the token so it can be revoked; SessionID is the refresh token
+// family it was issued to.
 type Claims struct {
-	Email string `json:"email"`
+	Email     string `json:"email"`
+	Role      string `json:"role,omitempty"`
+	SessionID string `json:"sid,omitempty"`
 	jwt.StandardClaims
 }
 
-func GenerateJWT(email string) (string, error) {
-	expirationTime := time.Now().Add(24 * time.Hour)
+// GenerateJWT signs an access token with ID tokenID for the user with email
+// and role, in session sessionID
+func GenerateJWT(email, role, sessionID, tokenID string) (string, error) {
+	now := time.Now()
 	claims := &Claims{
-		Email: email,
+		Email:     email,
+		Role:      role,
+		SessionID: sessionID,
 		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: expirationTime.Unix(),
+			Id:        tokenID,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(jwtTTL).Unix(),
 		},
 	}
 
@@ -41,7 +63,7 @@ func JWTMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		authHeader := r.Header.Get("Authorization")
 		if authHeader == "" {
-			http.Error(w, "Authorization header is required", http.StatusUnauthorized)
+			writeError(w, r, Unauthorized("missing_token", "Authorization header is required"))
 			return
 		}
 
@@ -53,11 +75,68 @@ func JWTMiddleware(next http.Handler) http.Handler {
 		})
 
 		if err != nil || !token.Valid {
-			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			writeError(w, r, Unauthorized("invalid_token", "Invalid token"))
+			return
+		}
+		user, err := checkSessionValid(r.Context(), claims)
+		if err != nil {
+			writeError(w, r, err)
 			return
 		}
+		// Tokens issued before they carried an ID can't be revoked one by
+		// one and simply run out
+		if claims.Id != "" {
+			revoked, err := isTokenRevoked(r.Context(), claims.Id)
+			if err != nil {
+				writeError(w, r, err)
+				return
+			}
+			if revoked {
+				writeError(w, r, errSessionRevoked)
+				return
+			}
+		}
 
 		ctx := context.WithValue(r.Context(), "userID", claims.Email)
+		ctx = context.WithValue(ctx, "role", claims.Role)
+		ctx = context.WithValue(ctx, "emailVerified", user.emailVerified)
+		ctx = context.WithValue(ctx, "sessionID", claims.SessionID)
+		ctx = withLogAttrs(ctx, slog.String("user", claims.Email))
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
+
+// isAdmin reports whether the token that authenticated r carries the admin role
+func isAdmin(r *http.Request) bool {
+	role, _ := r.Context().Value("role").(string)
+	return role == RoleAdmin
+}
+
+// isEmailVerified reports whether the user r is authenticated as has
+// verified their email address
+func isEmailVerified(r *http.Request) bool {
+	verified, _ := r.Context().Value("emailVerified").(bool)
+	return verified
+}
+
+// errSessionRevoked is returned for a token issued before the user's
+// sessions were revoked, e.g. by a password reset
+var errSessionRevoked = Unauthorized("session_revoked", "Session has been revoked, please log in again")
+
+// checkSessionValid rejects tokens issued to users that no longer exist or
+// before their sessions were revoked, and returns the user otherwise. Issue
+// times are in whole seconds, so a token from the same second as the
+// revocation is rejected too. Users are cached for sessionUserCacheTTL.
+func checkSessionValid(ctx context.Context, claims *Claims) (sessionUser, error) {
+	user, err := lookupSessionUser(ctx, claims.Email)
+	if err != nil {
+		return sessionUser{}, err
+	}
+	if !user.exists {
+		return sessionUser{}, errSessionRevoked
+	}
+	if !user.sessionsValidAfter.IsZero() && claims.IssuedAt <= user.sessionsValidAfter.Unix() {
+		return sessionUser{}, errSessionRevoked
+	}
+	return user, nil
+}
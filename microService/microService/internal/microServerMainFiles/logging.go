@@ -0,0 +1,208 @@
+package microServerMainFiles
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// maxRequestIDLength bounds a client supplied X-Request-ID so it can't be
+// used to bloat log lines
+const maxRequestIDLength = 128
+
+// redacted replaces the value of attributes whose key marks them as secret
+const redacted = "[REDACTED]"
+
+// sensitiveKeys are attribute keys whose values are never logged
+var sensitiveKeys = map[string]bool{
+	"password":      true,
+	"token":         true,
+	"access_token":  true,
+	"refresh_token": true,
+	"authorization": true,
+	"card_number":   true,
+	"cvv":           true,
+	"secret":        true,
+}
+
+var (
+	jwtPattern    = regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`)
+	bearerPattern = regexp.MustCompile(`(?i)bearer\s+[A-Za-z0-9._~+/=-]+`)
+	cardPattern   = regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`)
+	emailPattern  = regexp.MustCompile(`([A-Za-z0-9._%+-])[A-Za-z0-9._%+-]*@([A-Za-z0-9.-]+\.[A-Za-z]{2,})`)
+)
+
+// ScrubPII masks personal and secret data in s: tokens are removed, card
+// numbers keep only their last four digits and email addresses keep only
+// their first letter and domain
+func ScrubPII(s string) string {
+	s = jwtPattern.ReplaceAllString(s, redacted)
+	s = bearerPattern.ReplaceAllString(s, "Bearer "+redacted)
+	s = cardPattern.ReplaceAllStringFunc(s, func(card string) string {
+		digits := strings.NewReplacer(" ", "", "-", "").Replace(card)
+		return strings.Repeat("*", len(digits)-4) + digits[len(digits)-4:]
+	})
+	return emailPattern.ReplaceAllString(s, "$1***@$2")
+}
+
+// NewLogger returns a JSON logger writing to w that scrubs PII from every
+// message and attribute and adds the request fields carried by the context
+func NewLogger(w io.Writer, level slog.Level) *slog.Logger {
+	handler := slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level})
+	return slog.New(&contextHandler{scrubbingHandler{handler}})
+}
+
+// scrubbingHandler runs ScrubPII over everything it is asked to log
+type scrubbingHandler struct {
+	next slog.Handler
+}
+
+func (h scrubbingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h scrubbingHandler) Handle(ctx context.Context, record slog.Record) error {
+	scrubbed := slog.NewRecord(record.Time, record.Level, ScrubPII(record.Message), record.PC)
+	record.Attrs(func(attr slog.Attr) bool {
+		scrubbed.AddAttrs(scrubAttr(attr))
+		return true
+	})
+	return h.next.Handle(ctx, scrubbed)
+}
+
+func (h scrubbingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	scrubbed := make([]slog.Attr, len(attrs))
+	for i, attr := range attrs {
+		scrubbed[i] = scrubAttr(attr)
+	}
+	return scrubbingHandler{h.next.WithAttrs(scrubbed)}
+}
+
+func (h scrubbingHandler) WithGroup(name string) slog.Handler {
+	return scrubbingHandler{h.next.WithGroup(name)}
+}
+
+func scrubAttr(attr slog.Attr) slog.Attr {
+	if sensitiveKeys[strings.ToLower(attr.Key)] {
+		return slog.String(attr.Key, redacted)
+	}
+	value := attr.Value.Resolve()
+	switch value.Kind() {
+	case slog.KindString:
+		return slog.String(attr.Key, ScrubPII(value.String()))
+	case slog.KindGroup:
+		group := value.Group()
+		scrubbed := make([]any, len(group))
+		for i, member := range group {
+			scrubbed[i] = scrubAttr(member)
+		}
+		return slog.Group(attr.Key, scrubbed...)
+	case slog.KindAny:
+		// Errors and structs are flattened to text so nothing inside them
+		// escapes the scrubber
+		return slog.String(attr.Key, ScrubPII(fmt.Sprintf("%+v", value.Any())))
+	}
+	return slog.Attr{Key: attr.Key, Value: value}
+}
+
+// logAttrsKey is the context key for request fields added to every log line
+type logAttrsKey struct{}
+
+// withLogAttrs returns a copy of ctx whose log lines also carry attrs
+func withLogAttrs(ctx context.Context, attrs ...slog.Attr) context.Context {
+	existing, _ := ctx.Value(logAttrsKey{}).([]slog.Attr)
+	combined := make([]slog.Attr, 0, len(existing)+len(attrs))
+	combined = append(append(combined, existing...), attrs...)
+	return context.WithValue(ctx, logAttrsKey{}, combined)
+}
+
+// contextHandler adds the fields stored by withLogAttrs, and the trace and
+// span IDs of the current span, to records logged with a context, such as
+// through slog.InfoContext
+type contextHandler struct {
+	next slog.Handler
+}
+
+func (h *contextHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if attrs, ok := ctx.Value(logAttrsKey{}).([]slog.Attr); ok {
+		record = record.Clone()
+		record.AddAttrs(attrs...)
+	}
+	if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+		record = record.Clone()
+		record.AddAttrs(
+			slog.String("trace_id", span.TraceID().String()),
+			slog.String("span_id", span.SpanID().String()),
+		)
+	}
+	return h.next.Handle(ctx, record)
+}
+
+func (h *contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &contextHandler{h.next.WithAttrs(attrs)}
+}
+
+func (h *contextHandler) WithGroup(name string) slog.Handler {
+	return &contextHandler{h.next.WithGroup(name)}
+}
+
+// RequestIDMiddleware gives every request an ID, taken from the
+// X-Request-ID header when the client or a proxy sent a usable one, and
+// echoes it in the response. The ID, route and method are attached to every
+// line logged with the request's context, and one line is logged when the
+// request completes.
+func RequestIDMiddleware(route string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get("X-Request-ID")
+		if !validRequestID(requestID) {
+			requestID = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", requestID)
+
+		ctx := withLogAttrs(r.Context(),
+			slog.String("request_id", requestID),
+			slog.String("route", route),
+			slog.String("method", r.Method),
+		)
+
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		slog.InfoContext(ctx, "Request completed",
+			slog.String("path", r.URL.Path),
+			slog.Int("status", recorder.statusCode),
+			slog.Duration("duration", time.Since(start)),
+		)
+	})
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
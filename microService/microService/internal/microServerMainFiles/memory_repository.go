@@ -0,0 +1,853 @@
+package microServerMainFiles
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"microService/pkg/payment"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps users, products, carts, transactions, audit entries,
+// auth tokens and idempotency keys in process memory. It is safe for
+// concurrent use and is meant for tests and local runs without MongoDB;
+// nothing survives a restart. Values are copied in and out so callers never
+// share state with the store.
+type MemoryStore struct {
+	mu           sync.Mutex
+	users        map[string]UserCredentials
+	products     map[string]Product
+	carts        map[string]Cart
+	transactions map[primitive.ObjectID]Transaction
+	audit        []AuditEntry
+	resets       map[string]PasswordReset
+	tokens       map[string]RefreshToken
+	revoked      map[string]RevokedToken
+	idempotency  map[idempotencyKey]IdempotencyRecord
+}
+
+// idempotencyKey identifies an idempotency record in a MemoryStore
+type idempotencyKey struct {
+	userID string
+	key    string
+}
+
+// NewMemoryStore returns an empty store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:        make(map[string]UserCredentials),
+		products:     make(map[string]Product),
+		carts:        make(map[string]Cart),
+		transactions: make(map[primitive.ObjectID]Transaction),
+		resets:       make(map[string]PasswordReset),
+		tokens:       make(map[string]RefreshToken),
+		revoked:      make(map[string]RevokedToken),
+		idempotency:  make(map[idempotencyKey]IdempotencyRecord),
+	}
+}
+
+// NewMemoryRepositories returns repositories backed by a new MemoryStore
+func NewMemoryRepositories() Repositories {
+	store := NewMemoryStore()
+	return Repositories{
+		Users:           (*memoryUsers)(store),
+		Products:        (*memoryProducts)(store),
+		Carts:           (*memoryCarts)(store),
+		Transactions:    (*memoryTransactions)(store),
+		Audit:           (*memoryAudit)(store),
+		PasswordResets:  (*memoryPasswordResets)(store),
+		RefreshTokens:   (*memoryRefreshTokens)(store),
+		RevokedTokens:   (*memoryRevokedTokens)(store),
+		IdempotencyKeys: (*memoryIdempotencyKeys)(store),
+		Transactor:      store,
+	}
+}
+
+// memoryTxKey marks a context as running inside a WithTransaction call on
+// the store it holds, which already holds the lock
+type memoryTxKey struct{}
+
+// lock takes the store lock unless ctx belongs to a transaction that
+// already holds it, and returns the matching unlock
+func (s *MemoryStore) lock(ctx context.Context) func() {
+	if held, _ := ctx.Value(memoryTxKey{}).(*MemoryStore); held == s {
+		return func() {}
+	}
+	s.mu.Lock()
+	return s.mu.Unlock
+}
+
+// WithTransaction runs fn while holding the store lock, so other callers
+// see either none or all of its writes, and restores the previous contents
+// if fn fails
+func (s *MemoryStore) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	unlock := s.lock(ctx)
+	defer unlock()
+
+	snapshot := s.snapshot()
+	if err := fn(context.WithValue(ctx, memoryTxKey{}, s)); err != nil {
+		s.restore(snapshot)
+		return err
+	}
+	return nil
+}
+
+type memorySnapshot struct {
+	users        map[string]UserCredentials
+	products     map[string]Product
+	carts        map[string]Cart
+	transactions map[primitive.ObjectID]Transaction
+	audit        []AuditEntry
+	resets       map[string]PasswordReset
+	tokens       map[string]RefreshToken
+	revoked      map[string]RevokedToken
+	idempotency  map[idempotencyKey]IdempotencyRecord
+}
+
+func (s *MemoryStore) snapshot() memorySnapshot {
+	snapshot := memorySnapshot{
+		users:        make(map[string]UserCredentials, len(s.users)),
+		products:     make(map[string]Product, len(s.products)),
+		carts:        make(map[string]Cart, len(s.carts)),
+		transactions: make(map[primitive.ObjectID]Transaction, len(s.transactions)),
+		audit:        append([]AuditEntry(nil), s.audit...),
+		resets:       make(map[string]PasswordReset, len(s.resets)),
+		tokens:       make(map[string]RefreshToken, len(s.tokens)),
+		revoked:      make(map[string]RevokedToken, len(s.revoked)),
+		idempotency:  make(map[idempotencyKey]IdempotencyRecord, len(s.idempotency)),
+	}
+	for email, user := range s.users {
+		snapshot.users[email] = user
+	}
+	for id, product := range s.products {
+		snapshot.products[id] = product
+	}
+	for userID, cart := range s.carts {
+		snapshot.carts[userID] = copyCart(cart)
+	}
+	for id, transaction := range s.transactions {
+		snapshot.transactions[id] = copyTransaction(transaction)
+	}
+	for hash, reset := range s.resets {
+		snapshot.resets[hash] = reset
+	}
+	for hash, token := range s.tokens {
+		snapshot.tokens[hash] = token
+	}
+	for id, token := range s.revoked {
+		snapshot.revoked[id] = token
+	}
+	for key, record := range s.idempotency {
+		snapshot.idempotency[key] = record
+	}
+	return snapshot
+}
+
+func (s *MemoryStore) restore(snapshot memorySnapshot) {
+	s.users = snapshot.users
+	s.products = snapshot.products
+	s.carts = snapshot.carts
+	s.transactions = snapshot.transactions
+	s.audit = snapshot.audit
+	s.resets = snapshot.resets
+	s.tokens = snapshot.tokens
+	s.revoked = snapshot.revoked
+	s.idempotency = snapshot.idempotency
+}
+
+func copyItems(items []CartItem) []CartItem {
+	if items == nil {
+		return nil
+	}
+	return append([]CartItem{}, items...)
+}
+
+func copyCart(cart Cart) Cart {
+	cart.Items = copyItems(cart.Items)
+	return cart
+}
+
+func copyTransaction(transaction Transaction) Transaction {
+	transaction.Items = copyItems(transaction.Items)
+	if transaction.StatusHistory != nil {
+		transaction.StatusHistory = append([]StatusChange{}, transaction.StatusHistory...)
+	}
+	if transaction.Refunds != nil {
+		refunds := make([]Refund, len(transaction.Refunds))
+		for i, refund := range transaction.Refunds {
+			refund.Items = copyItems(refund.Items)
+			refunds[i] = refund
+		}
+		transaction.Refunds = refunds
+	}
+	if transaction.PaymentMethod != nil {
+		method := *transaction.PaymentMethod
+		transaction.PaymentMethod = &method
+	}
+	if transaction.VoidedAt != nil {
+		at := *transaction.VoidedAt
+		transaction.VoidedAt = &at
+	}
+	return transaction
+}
+
+// memoryUsers implements UserRepository on a MemoryStore
+type memoryUsers MemoryStore
+
+// EnsureIndexes has nothing to do: the map is keyed by email
+func (r *memoryUsers) EnsureIndexes(ctx context.Context) error {
+	return nil
+}
+
+// VerifyLegacyUsers finds none, as no user in memory predates verification
+func (r *memoryUsers) VerifyLegacyUsers(ctx context.Context) (int64, error) {
+	return 0, nil
+}
+
+func (r *memoryUsers) Save(ctx context.Context, user UserCredentials) error {
+	s := (*MemoryStore)(r)
+	defer s.lock(ctx)()
+	if _, ok := s.users[user.Email]; ok {
+		return ErrDuplicate
+	}
+	s.users[user.Email] = user
+	return nil
+}
+
+func (r *memoryUsers) GetByEmail(ctx context.Context, email string) (UserCredentials, error) {
+	s := (*MemoryStore)(r)
+	defer s.lock(ctx)()
+	user, ok := s.users[email]
+	if !ok {
+		return UserCredentials{}, ErrNotFound
+	}
+	return user, nil
+}
+
+func (r *memoryUsers) UpdatePassword(ctx context.Context, email, passwordHash string) error {
+	s := (*MemoryStore)(r)
+	defer s.lock(ctx)()
+	user, ok := s.users[email]
+	if !ok {
+		return ErrNotFound
+	}
+	user.Password = passwordHash
+	s.users[email] = user
+	return nil
+}
+
+func (r *memoryUsers) RevokeSessions(ctx context.Context, email string, at time.Time) error {
+	s := (*MemoryStore)(r)
+	defer s.lock(ctx)()
+	user, ok := s.users[email]
+	if !ok {
+		return ErrNotFound
+	}
+	user.SessionsValidAfter = at
+	s.users[email] = user
+	return nil
+}
+
+func (r *memoryUsers) SetVerificationToken(ctx context.Context, email, tokenHash string, expiresAt time.Time) error {
+	s := (*MemoryStore)(r)
+	defer s.lock(ctx)()
+	user, ok := s.users[email]
+	if !ok {
+		return ErrNotFound
+	}
+	user.VerificationTokenHash = tokenHash
+	user.VerificationExpiresAt = expiresAt
+	s.users[email] = user
+	return nil
+}
+
+func (r *memoryUsers) VerifyEmail(ctx context.Context, tokenHash string, now time.Time) (string, error) {
+	s := (*MemoryStore)(r)
+	defer s.lock(ctx)()
+	for email, user := range s.users {
+		if user.VerificationTokenHash == tokenHash && user.VerificationExpiresAt.After(now) {
+			user.EmailVerified = true
+			user.VerificationTokenHash = ""
+			user.VerificationExpiresAt = time.Time{}
+			s.users[email] = user
+			return email, nil
+		}
+	}
+	return "", ErrNotFound
+}
+
+// memoryProducts implements ProductRepository on a MemoryStore
+type memoryProducts MemoryStore
+
+func (r *memoryProducts) EnsureIndexes(ctx context.Context) error {
+	return nil
+}
+
+// BackfillStock finds none, as every product in memory has a stock level
+func (r *memoryProducts) BackfillStock(ctx context.Context, stock int) (int64, error) {
+	return 0, nil
+}
+
+func (r *memoryProducts) List(ctx context.Context) ([]Product, error) {
+	s := (*MemoryStore)(r)
+	defer s.lock(ctx)()
+	list := make([]Product, 0, len(s.products))
+	for _, product := range s.products {
+		list = append(list, product)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list, nil
+}
+
+func (r *memoryProducts) Get(ctx context.Context, productID string) (*Product, error) {
+	s := (*MemoryStore)(r)
+	defer s.lock(ctx)()
+	product, ok := s.products[productID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &product, nil
+}
+
+func (r *memoryProducts) Insert(ctx context.Context, product *Product) error {
+	s := (*MemoryStore)(r)
+	defer s.lock(ctx)()
+	if _, ok := s.products[product.ID]; ok {
+		return ErrDuplicate
+	}
+	s.products[product.ID] = *product
+	return nil
+}
+
+func (r *memoryProducts) Update(ctx context.Context, product *Product) error {
+	s := (*MemoryStore)(r)
+	defer s.lock(ctx)()
+	stored, ok := s.products[product.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	stored.Name = product.Name
+	stored.Price = product.Price
+	stored.Description = product.Description
+	stored.ImageURL = product.ImageURL
+	stored.Stock = product.Stock
+	stored.UpdatedAt = product.UpdatedAt
+	s.products[product.ID] = stored
+	*product = stored
+	return nil
+}
+
+func (r *memoryProducts) Delete(ctx context.Context, productID string) error {
+	s := (*MemoryStore)(r)
+	defer s.lock(ctx)()
+	if _, ok := s.products[productID]; !ok {
+		return ErrNotFound
+	}
+	delete(s.products, productID)
+	return nil
+}
+
+// ReserveStock checks every line before changing any, so it is all or
+// nothing even outside a transaction
+func (r *memoryProducts) ReserveStock(ctx context.Context, items []CartItem) error {
+	s := (*MemoryStore)(r)
+	defer s.lock(ctx)()
+	requested := make(map[string]int)
+	for _, item := range items {
+		requested[item.ProductID] += item.Quantity
+		if s.products[item.ProductID].Stock < requested[item.ProductID] {
+			return &InsufficientStockError{ProductID: item.ProductID, Requested: requested[item.ProductID]}
+		}
+	}
+	s.adjustStock(items, -1, 1)
+	return nil
+}
+
+func (r *memoryProducts) ReleaseStock(ctx context.Context, items []CartItem) error {
+	s := (*MemoryStore)(r)
+	defer s.lock(ctx)()
+	s.adjustStock(items, 1, -1)
+	return nil
+}
+
+func (r *memoryProducts) CommitStock(ctx context.Context, items []CartItem) error {
+	s := (*MemoryStore)(r)
+	defer s.lock(ctx)()
+	s.adjustStock(items, 0, -1)
+	return nil
+}
+
+func (r *memoryProducts) Restock(ctx context.Context, items []CartItem) error {
+	s := (*MemoryStore)(r)
+	defer s.lock(ctx)()
+	s.adjustStock(items, 1, 0)
+	return nil
+}
+
+// adjustStock adds each item's quantity times stockSign to stock and times
+// reservedSign to reserved. Unknown products are skipped, as the Mongo
+// updates match nothing for them.
+func (s *MemoryStore) adjustStock(items []CartItem, stockSign, reservedSign int) {
+	for _, item := range items {
+		product, ok := s.products[item.ProductID]
+		if !ok {
+			continue
+		}
+		product.Stock += stockSign * item.Quantity
+		product.Reserved += reservedSign * item.Quantity
+		s.products[item.ProductID] = product
+	}
+}
+
+// memoryCarts implements CartRepository on a MemoryStore
+type memoryCarts MemoryStore
+
+func (r *memoryCarts) Get(ctx context.Context, userID string) (*Cart, error) {
+	s := (*MemoryStore)(r)
+	defer s.lock(ctx)()
+	cart, ok := s.carts[userID]
+	if !ok {
+		return &Cart{UserID: userID, Items: []CartItem{}}, nil
+	}
+	cart = copyCart(cart)
+	return &cart, nil
+}
+
+func (r *memoryCarts) AddItem(ctx context.Context, userID string, item CartItem) (bool, error) {
+	s := (*MemoryStore)(r)
+	defer s.lock(ctx)()
+	cart, existed := s.carts[userID]
+	cart.UserID = userID
+	cart.UpdatedAt = time.Now()
+	for i := range cart.Items {
+		if cart.Items[i].ProductID == item.ProductID {
+			cart.Items[i].Quantity += item.Quantity
+			cart.Items[i].Price = item.Price
+			s.carts[userID] = cart
+			return false, nil
+		}
+	}
+	cart.Items = append(copyItems(cart.Items), item)
+	s.carts[userID] = cart
+	return !existed, nil
+}
+
+func (r *memoryCarts) SetItemQuantity(ctx context.Context, userID, productID string, quantity int) error {
+	s := (*MemoryStore)(r)
+	defer s.lock(ctx)()
+	cart, ok := s.carts[userID]
+	if !ok {
+		return ErrNotFound
+	}
+	for i := range cart.Items {
+		if cart.Items[i].ProductID == productID {
+			cart.Items[i].Quantity = quantity
+			cart.UpdatedAt = time.Now()
+			s.carts[userID] = cart
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (r *memoryCarts) RemoveItem(ctx context.Context, userID, productID string) error {
+	s := (*MemoryStore)(r)
+	defer s.lock(ctx)()
+	cart, ok := s.carts[userID]
+	if !ok {
+		return ErrNotFound
+	}
+	for i, item := range cart.Items {
+		if item.ProductID == productID {
+			items := append(copyItems(cart.Items[:i]), cart.Items[i+1:]...)
+			cart.Items = items
+			cart.UpdatedAt = time.Now()
+			s.carts[userID] = cart
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (r *memoryCarts) Clear(ctx context.Context, userID string) error {
+	s := (*MemoryStore)(r)
+	defer s.lock(ctx)()
+	// Like the Mongo update, clearing a cart that doesn't exist is a no-op
+	if cart, ok := s.carts[userID]; ok {
+		cart.Items = []CartItem{}
+		cart.UpdatedAt = time.Now()
+		s.carts[userID] = cart
+	}
+	return nil
+}
+
+// memoryTransactions implements TransactionRepository on a MemoryStore
+type memoryTransactions MemoryStore
+
+func (r *memoryTransactions) Insert(ctx context.Context, transaction *Transaction) error {
+	s := (*MemoryStore)(r)
+	defer s.lock(ctx)()
+	transaction.ID = primitive.NewObjectID()
+	s.transactions[transaction.ID] = copyTransaction(*transaction)
+	return nil
+}
+
+func (r *memoryTransactions) Get(ctx context.Context, transactionID primitive.ObjectID) (*Transaction, error) {
+	s := (*MemoryStore)(r)
+	defer s.lock(ctx)()
+	transaction, ok := s.transactions[transactionID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	transaction = copyTransaction(transaction)
+	return &transaction, nil
+}
+
+func (r *memoryTransactions) FindPending(ctx context.Context, userID string, now time.Time) (*Transaction, error) {
+	s := (*MemoryStore)(r)
+	defer s.lock(ctx)()
+	for _, transaction := range s.sortedTransactions() {
+		if transaction.UserID == userID && transaction.Status == StatusPending &&
+			(transaction.ExpiresAt.IsZero() || transaction.ExpiresAt.After(now)) {
+			transaction = copyTransaction(transaction)
+			return &transaction, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (r *memoryTransactions) ListByUser(ctx context.Context, userID string) ([]Transaction, error) {
+	s := (*MemoryStore)(r)
+	defer s.lock(ctx)()
+	var list []Transaction
+	for _, transaction := range s.sortedTransactions() {
+		if transaction.UserID == userID && transaction.VoidedAt == nil {
+			list = append(list, copyTransaction(transaction))
+		}
+	}
+	return list, nil
+}
+
+func (r *memoryTransactions) ListExpired(ctx context.Context, now time.Time) ([]Transaction, error) {
+	s := (*MemoryStore)(r)
+	defer s.lock(ctx)()
+	var list []Transaction
+	for _, transaction := range s.sortedTransactions() {
+		expiresAt := transaction.ExpiresAt
+		if transaction.Status == StatusAwaitingPayment {
+			expiresAt = expiresAt.Add(awaitingPaymentGrace)
+		} else if transaction.Status != StatusPending {
+			continue
+		}
+		if !transaction.ExpiresAt.IsZero() && !expiresAt.After(now) {
+			list = append(list, copyTransaction(transaction))
+		}
+	}
+	return list, nil
+}
+
+func (r *memoryTransactions) UpdateStatus(ctx context.Context, transactionID primitive.ObjectID, from TransactionStatus, change StatusChange) (bool, error) {
+	s := (*MemoryStore)(r)
+	defer s.lock(ctx)()
+	transaction, ok := s.transactions[transactionID]
+	if !ok || transaction.Status != from {
+		return false, nil
+	}
+	transaction.Status = change.To
+	transaction.StatusHistory = append(append([]StatusChange{}, transaction.StatusHistory...), change)
+	s.transactions[transactionID] = transaction
+	return true, nil
+}
+
+func (r *memoryTransactions) ReplaceStatus(ctx context.Context, from TransactionStatus, change StatusChange) (int64, error) {
+	s := (*MemoryStore)(r)
+	defer s.lock(ctx)()
+	var replaced int64
+	for id, transaction := range s.transactions {
+		if transaction.Status != from {
+			continue
+		}
+		transaction.Status = change.To
+		transaction.StatusHistory = append(append([]StatusChange{}, transaction.StatusHistory...), change)
+		s.transactions[id] = transaction
+		replaced++
+	}
+	return replaced, nil
+}
+
+func (r *memoryTransactions) SetPayment(ctx context.Context, transactionID primitive.ObjectID, paymentID string, method payment.MaskedCard) error {
+	return r.update(ctx, transactionID, func(transaction *Transaction) {
+		transaction.PaymentID = paymentID
+		transaction.PaymentMethod = &method
+	})
+}
+
+func (r *memoryTransactions) AddRefund(ctx context.Context, transactionID primitive.ObjectID, status TransactionStatus, existingRefunds int, refund Refund) (bool, error) {
+	s := (*MemoryStore)(r)
+	defer s.lock(ctx)()
+	transaction, ok := s.transactions[transactionID]
+	if !ok || transaction.Status != status || len(transaction.Refunds) != existingRefunds {
+		return false, nil
+	}
+	refund.Items = copyItems(refund.Items)
+	transaction = copyTransaction(transaction)
+	transaction.Refunds = append(transaction.Refunds, refund)
+	s.transactions[transactionID] = transaction
+	return true, nil
+}
+
+func (r *memoryTransactions) RemoveRefund(ctx context.Context, transactionID primitive.ObjectID, refundID primitive.ObjectID) error {
+	return r.update(ctx, transactionID, func(transaction *Transaction) {
+		var kept []Refund
+		for _, refund := range transaction.Refunds {
+			if refund.ID != refundID {
+				kept = append(kept, refund)
+			}
+		}
+		transaction.Refunds = kept
+	})
+}
+
+func (r *memoryTransactions) MarkVoided(ctx context.Context, transactionID primitive.ObjectID, at time.Time, by string) error {
+	return r.update(ctx, transactionID, func(transaction *Transaction) {
+		transaction.VoidedAt = &at
+		transaction.VoidedBy = by
+	})
+}
+
+func (r *memoryTransactions) Delete(ctx context.Context, transactionID primitive.ObjectID) error {
+	s := (*MemoryStore)(r)
+	defer s.lock(ctx)()
+	if _, ok := s.transactions[transactionID]; !ok {
+		return ErrNotFound
+	}
+	delete(s.transactions, transactionID)
+	return nil
+}
+
+// update applies fn to a copy of the stored transaction and stores the result
+func (r *memoryTransactions) update(ctx context.Context, transactionID primitive.ObjectID, fn func(*Transaction)) error {
+	s := (*MemoryStore)(r)
+	defer s.lock(ctx)()
+	transaction, ok := s.transactions[transactionID]
+	if !ok {
+		return ErrNotFound
+	}
+	transaction = copyTransaction(transaction)
+	fn(&transaction)
+	s.transactions[transactionID] = transaction
+	return nil
+}
+
+// sortedTransactions returns the stored transactions in creation order, the
+// order MongoDB returns them in when no sort is given
+func (s *MemoryStore) sortedTransactions() []Transaction {
+	list := make([]Transaction, 0, len(s.transactions))
+	for _, transaction := range s.transactions {
+		list = append(list, transaction)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID.Hex() < list[j].ID.Hex()
+	})
+	return list
+}
+
+// memoryAudit implements AuditLog on a MemoryStore
+type memoryAudit MemoryStore
+
+func (l *memoryAudit) Record(ctx context.Context, entry AuditEntry) error {
+	s := (*MemoryStore)(l)
+	defer s.lock(ctx)()
+	s.audit = append(s.audit, entry)
+	return nil
+}
+
+// memoryPasswordResets implements PasswordResetRepository on a MemoryStore
+type memoryPasswordResets MemoryStore
+
+func (r *memoryPasswordResets) EnsureIndexes(ctx context.Context) error {
+	return nil
+}
+
+func (r *memoryPasswordResets) Create(ctx context.Context, reset PasswordReset) error {
+	s := (*MemoryStore)(r)
+	defer s.lock(ctx)()
+	for hash, existing := range s.resets {
+		if existing.Email == reset.Email {
+			delete(s.resets, hash)
+		}
+	}
+	s.resets[reset.TokenHash] = reset
+	return nil
+}
+
+func (r *memoryPasswordResets) Get(ctx context.Context, tokenHash string, now time.Time) (PasswordReset, error) {
+	s := (*MemoryStore)(r)
+	defer s.lock(ctx)()
+	reset, ok := s.resets[tokenHash]
+	if !ok || !reset.ExpiresAt.After(now) {
+		return PasswordReset{}, ErrNotFound
+	}
+	return reset, nil
+}
+
+func (r *memoryPasswordResets) Consume(ctx context.Context, tokenHash string) error {
+	s := (*MemoryStore)(r)
+	defer s.lock(ctx)()
+	if _, ok := s.resets[tokenHash]; !ok {
+		return ErrNotFound
+	}
+	delete(s.resets, tokenHash)
+	return nil
+}
+
+// memoryRefreshTokens implements RefreshTokenRepository on a MemoryStore
+type memoryRefreshTokens MemoryStore
+
+func (r *memoryRefreshTokens) EnsureIndexes(ctx context.Context) error {
+	return nil
+}
+
+func (r *memoryRefreshTokens) Create(ctx context.Context, token RefreshToken) error {
+	s := (*MemoryStore)(r)
+	defer s.lock(ctx)()
+	if _, ok := s.tokens[token.TokenHash]; ok {
+		return ErrDuplicate
+	}
+	s.tokens[token.TokenHash] = token
+	return nil
+}
+
+func (r *memoryRefreshTokens) Get(ctx context.Context, tokenHash string) (RefreshToken, error) {
+	s := (*MemoryStore)(r)
+	defer s.lock(ctx)()
+	token, ok := s.tokens[tokenHash]
+	if !ok {
+		return RefreshToken{}, ErrNotFound
+	}
+	return token, nil
+}
+
+func (r *memoryRefreshTokens) MarkUsed(ctx context.Context, tokenHash string, at time.Time) error {
+	s := (*MemoryStore)(r)
+	defer s.lock(ctx)()
+	token, ok := s.tokens[tokenHash]
+	if !ok || !token.UsedAt.IsZero() {
+		return ErrNotFound
+	}
+	token.UsedAt = at
+	s.tokens[tokenHash] = token
+	return nil
+}
+
+func (r *memoryRefreshTokens) RevokeFamily(ctx context.Context, family string, at time.Time) error {
+	s := (*MemoryStore)(r)
+	defer s.lock(ctx)()
+	for hash, token := range s.tokens {
+		if token.Family == family && token.RevokedAt.IsZero() {
+			token.RevokedAt = at
+			s.tokens[hash] = token
+		}
+	}
+	return nil
+}
+
+func (r *memoryRefreshTokens) ListFamily(ctx context.Context, family string) ([]RefreshToken, error) {
+	s := (*MemoryStore)(r)
+	defer s.lock(ctx)()
+	var tokens []RefreshToken
+	for _, token := range s.tokens {
+		if token.Family == family {
+			tokens = append(tokens, token)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].CreatedAt.Before(tokens[j].CreatedAt) })
+	return tokens, nil
+}
+
+func (r *memoryRefreshTokens) ListActive(ctx context.Context, email string, now time.Time) ([]RefreshToken, error) {
+	s := (*MemoryStore)(r)
+	defer s.lock(ctx)()
+	var tokens []RefreshToken
+	for _, token := range s.tokens {
+		if token.Email == email && token.UsedAt.IsZero() && token.RevokedAt.IsZero() && token.ExpiresAt.After(now) {
+			tokens = append(tokens, token)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].SessionStart.After(tokens[j].SessionStart) })
+	return tokens, nil
+}
+
+// memoryRevokedTokens implements RevokedTokenRepository on a MemoryStore
+type memoryRevokedTokens MemoryStore
+
+func (r *memoryRevokedTokens) EnsureIndexes(ctx context.Context) error {
+	return nil
+}
+
+func (r *memoryRevokedTokens) Revoke(ctx context.Context, token RevokedToken) error {
+	s := (*MemoryStore)(r)
+	defer s.lock(ctx)()
+	s.revoked[token.ID] = token
+	return nil
+}
+
+func (r *memoryRevokedTokens) IsRevoked(ctx context.Context, tokenID string) (bool, error) {
+	s := (*MemoryStore)(r)
+	defer s.lock(ctx)()
+	_, ok := s.revoked[tokenID]
+	return ok, nil
+}
+
+// memoryIdempotencyKeys implements IdempotencyKeyRepository on a MemoryStore
+type memoryIdempotencyKeys MemoryStore
+
+func (r *memoryIdempotencyKeys) EnsureIndexes(ctx context.Context) error {
+	return nil
+}
+
+func (r *memoryIdempotencyKeys) Claim(ctx context.Context, record IdempotencyRecord, staleBefore time.Time) (bool, error) {
+	s := (*MemoryStore)(r)
+	defer s.lock(ctx)()
+	key := idempotencyKey{userID: record.UserID, key: record.Key}
+	if existing, ok := s.idempotency[key]; ok && !existing.CreatedAt.Before(staleBefore) {
+		return false, nil
+	}
+	s.idempotency[key] = record
+	return true, nil
+}
+
+func (r *memoryIdempotencyKeys) Get(ctx context.Context, userID, key string) (IdempotencyRecord, error) {
+	s := (*MemoryStore)(r)
+	defer s.lock(ctx)()
+	record, ok := s.idempotency[idempotencyKey{userID: userID, key: key}]
+	if !ok {
+		return IdempotencyRecord{}, ErrNotFound
+	}
+	record.Body = append([]byte(nil), record.Body...)
+	return record, nil
+}
+
+func (r *memoryIdempotencyKeys) Complete(ctx context.Context, userID, key string, statusCode int, contentType string, body []byte) error {
+	s := (*MemoryStore)(r)
+	defer s.lock(ctx)()
+	id := idempotencyKey{userID: userID, key: key}
+	record, ok := s.idempotency[id]
+	if !ok {
+		return nil
+	}
+	record.Completed = true
+	record.StatusCode = statusCode
+	record.ContentType = contentType
+	record.Body = append([]byte(nil), body...)
+	s.idempotency[id] = record
+	return nil
+}
+
+func (r *memoryIdempotencyKeys) Release(ctx context.Context, userID, key string) error {
+	s := (*MemoryStore)(r)
+	defer s.lock(ctx)()
+	delete(s.idempotency, idempotencyKey{userID: userID, key: key})
+	return nil
+}
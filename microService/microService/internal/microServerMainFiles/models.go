@@ -2,15 +2,20 @@ package microServerMainFiles
 
 import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"microService/pkg/payment"
 	"time"
 )
 
 // Product represents an item that can be purchased
 type Product struct {
-	ID          string  `bson:"id"`
-	Name        string  `bson:"name"`
-	Price       float64 `bson:"price"`
-	Description string  `bson:"description"`
+	ID          string    `bson:"id" json:"id"`
+	Name        string    `bson:"name" json:"name"`
+	Price       float64   `bson:"price" json:"price"`
+	Description string    `bson:"description" json:"description"`
+	ImageURL    string    `bson:"image_url" json:"image_url"`
+	Stock       int       `bson:"stock" json:"stock"`       // Units available to reserve
+	Reserved    int       `bson:"reserved" json:"reserved"` // Units held by pending transactions
+	UpdatedAt   time.Time `bson:"updated_at" json:"updated_at"`
 }
 
 // Cart represents a shopping cart
@@ -21,10 +26,27 @@ type Cart struct {
 }
 
 type Transaction struct {
-	ID          primitive.ObjectID `bson:"_id,omitempty"`
-	UserID      string             `bson:"user_id"`
-	Items       []CartItem         `bson:"items"`
-	TotalAmount float64            `bson:"total_amount"`
-	Status      string             `bson:"status"`
-	CreatedAt   time.Time          `bson:"created_at"`
+	ID            primitive.ObjectID  `bson:"_id,omitempty"`
+	UserID        string              `bson:"user_id"`
+	Items         []CartItem          `bson:"items"`
+	TotalAmount   float64             `bson:"total_amount"`
+	Status        TransactionStatus   `bson:"status"`
+	StatusHistory []StatusChange      `bson:"status_history"`
+	CreatedAt     time.Time           `bson:"created_at"`
+	ExpiresAt     time.Time           `bson:"expires_at,omitempty"`     // Pending transactions expire and release their stock after this
+	StockReserved bool                `bson:"stock_reserved"`           // Whether checkout reserved stock for the items
+	PaymentID     string              `bson:"payment_id,omitempty"`     // Gateway authorization that paid for the transaction
+	PaymentMethod *payment.MaskedCard `bson:"payment_method,omitempty"` // Brand and last four digits of the card; never the full number
+	Refunds       []Refund            `bson:"refunds,omitempty"`
+	VoidedAt      *time.Time          `bson:"voided_at,omitempty"` // Set when a pending transaction is voided; voided transactions are hidden from the user
+	VoidedBy      string              `bson:"voided_by,omitempty"`
+}
+
+// Refund records money returned against a paid transaction
+type Refund struct {
+	ID        primitive.ObjectID `bson:"id"`
+	Items     []CartItem         `bson:"items"` // Lines and quantities refunded, at the price paid
+	Amount    float64            `bson:"amount"`
+	Actor     string             `bson:"actor"`
+	CreatedAt time.Time          `bson:"created_at"`
 }
@@ -0,0 +1,156 @@
+package microServerMainFiles
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxPasswordBytes is the longest password bcrypt can hash; anything after
+// it would be silently ignored
+const maxPasswordBytes = 72
+
+// PasswordPolicy is the strength a user-chosen password must have
+type PasswordPolicy struct {
+	MinLength     int
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+}
+
+var passwordPolicy = PasswordPolicy{MinLength: 12}
+
+// commonPasswords are rejected even without a breached password list
+var commonPasswords = []string{
+	"123456789012", "password1234", "passwordpassword", "qwertyuiopas",
+	"letmein12345", "iloveyou1234", "administrator", "welcome12345",
+	"Password123!", "Passw0rd1234", "changeme1234", "abc123456789",
+}
+
+// breachedPasswords holds upper case SHA-1 hex digests of passwords known to
+// have leaked, so the list is the same size whatever it was loaded from
+var breachedPasswords = hashPasswords(commonPasswords)
+
+// SetPasswordPolicy sets the policy checked by CheckPassword
+func SetPasswordPolicy(policy PasswordPolicy) {
+	passwordPolicy = policy
+}
+
+// LoadBreachedPasswords adds the passwords listed in the file at path to the
+// breached list. Each line is either a password or, as in the Have I Been
+// Pwned downloads, a SHA-1 hex digest optionally followed by ":count".
+func LoadBreachedPasswords(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	loaded := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		digest, _, _ := strings.Cut(line, ":")
+		if !isSHA1Hex(digest) {
+			digest = passwordDigest(line)
+		}
+		breachedPasswords[strings.ToUpper(digest)] = struct{}{}
+		loaded++
+	}
+	if err := scanner.Err(); err != nil {
+		return loaded, fmt.Errorf("reading %s: %w", path, err)
+	}
+	return loaded, nil
+}
+
+// CheckPassword returns a validation error listing every way password falls
+// short of the policy, or nil if it is acceptable. A password equal to the
+// email address is rejected too.
+func CheckPassword(password, email string) error {
+	return checkPassword("password", password, email)
+}
+
+// checkPassword is CheckPassword reporting problems against field
+func checkPassword(field, password, email string) error {
+	var problems []string
+	if utf8.RuneCountInString(password) < passwordPolicy.MinLength {
+		problems = append(problems, fmt.Sprintf("must be at least %d characters", passwordPolicy.MinLength))
+	}
+	if len(password) > maxPasswordBytes {
+		problems = append(problems, fmt.Sprintf("must be at most %d bytes", maxPasswordBytes))
+	}
+
+	var upper, lower, digit, symbol bool
+	for _, c := range password {
+		switch {
+		case unicode.IsUpper(c):
+			upper = true
+		case unicode.IsLower(c):
+			lower = true
+		case unicode.IsDigit(c):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	if passwordPolicy.RequireUpper && !upper {
+		problems = append(problems, "must contain an upper case letter")
+	}
+	if passwordPolicy.RequireLower && !lower {
+		problems = append(problems, "must contain a lower case letter")
+	}
+	if passwordPolicy.RequireDigit && !digit {
+		problems = append(problems, "must contain a digit")
+	}
+	if passwordPolicy.RequireSymbol && !symbol {
+		problems = append(problems, "must contain a symbol")
+	}
+
+	if email != "" && strings.EqualFold(password, email) {
+		problems = append(problems, "must not be your email address")
+	}
+	if _, ok := breachedPasswords[passwordDigest(password)]; ok {
+		problems = append(problems, "appears in a list of breached passwords")
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	fields := make([]FieldError, len(problems))
+	for i, problem := range problems {
+		fields[i] = FieldError{Field: field, Message: problem}
+	}
+	return Validation("weak_password", "Password does not meet the password policy", fields...)
+}
+
+// passwordDigest returns the upper case SHA-1 hex digest of password, the
+// form breached lists are kept in
+func passwordDigest(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+func hashPasswords(passwords []string) map[string]struct{} {
+	digests := make(map[string]struct{}, len(passwords))
+	for _, password := range passwords {
+		digests[passwordDigest(password)] = struct{}{}
+	}
+	return digests
+}
+
+func isSHA1Hex(s string) bool {
+	if len(s) != 2*sha1.Size {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
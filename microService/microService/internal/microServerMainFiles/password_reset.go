@@ -0,0 +1,188 @@
+package microServerMainFiles
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"golang.org/x/crypto/bcrypt"
+	"log/slog"
+	"microService/pkg/email"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// secureTokenBytes is the amount of randomness in emailed tokens
+const secureTokenBytes = 32
+
+// PasswordReset is a pending password reset. Only the SHA-256 hash of the
+// emailed token is stored, so a leaked collection can't be used to reset
+// anyone's password.
+type PasswordReset struct {
+	TokenHash string    `bson:"token_hash"`
+	Email     string    `bson:"email"`
+	CreatedAt time.Time `bson:"created_at"`
+	ExpiresAt time.Time `bson:"expires_at"`
+}
+
+var (
+	resetTokenTTL = 30 * time.Minute
+	publicURL     = "http://localhost:8080"
+)
+
+// errInvalidResetToken covers unknown, expired and already used tokens alike
+var errInvalidResetToken = Validation("invalid_reset_token", "This reset link is invalid or has expired", FieldError{Field: "token", Message: "is invalid or has expired"})
+
+// SetPasswordResetConfig sets how long reset tokens last and the public URL
+// of the site the reset link in the email points to
+func SetPasswordResetConfig(ttl time.Duration, siteURL string) {
+	resetTokenTTL = ttl
+	publicURL = strings.TrimSuffix(siteURL, "/")
+}
+
+// RequestPasswordReset emails a reset link to the user with address, if
+// there is one. A new request replaces any earlier link. Unknown addresses
+// are not an error so callers can't tell them apart.
+func RequestPasswordReset(ctx context.Context, address string) error {
+	if _, err := users.GetByEmail(ctx, address); err != nil {
+		if err == ErrNotFound {
+			slog.InfoContext(ctx, "Password reset requested for unknown email")
+			return nil
+		}
+		return err
+	}
+
+	token, err := newSecureToken()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	err = passwordResets.Create(ctx, PasswordReset{
+		TokenHash: hashToken(token),
+		Email:     address,
+		CreatedAt: now,
+		ExpiresAt: now.Add(resetTokenTTL),
+	})
+	if err != nil {
+		return err
+	}
+
+	link := publicURL + "/reset-password.html?token=" + url.QueryEscape(token)
+	body := "Someone asked to reset the password of your account. If it was you, open this link within " +
+		resetTokenTTL.String() + " to choose a new password:\n\n" + link +
+		"\n\nIf it wasn't you, ignore this email; your password has not changed."
+	return email.SendEmail(address, "Reset your password", body)
+}
+
+// ResetPassword sets a new password for the user the token was issued to and
+// revokes all of their sessions. The token can only be used once.
+func ResetPassword(ctx context.Context, token, newPassword string) error {
+	tokenHash := hashToken(token)
+	reset, err := passwordResets.Get(ctx, tokenHash, time.Now())
+	if err == ErrNotFound {
+		return errInvalidResetToken
+	}
+	if err != nil {
+		return err
+	}
+	if err := CheckPassword(newPassword, reset.Email); err != nil {
+		return err
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	err = transactor.WithTransaction(ctx, func(ctx context.Context) error {
+		// Whoever deletes the reset first gets to use it
+		if err := passwordResets.Consume(ctx, tokenHash); err != nil {
+			if err == ErrNotFound {
+				return errInvalidResetToken
+			}
+			return err
+		}
+		if err := users.UpdatePassword(ctx, reset.Email, string(hashedPassword)); err != nil {
+			return err
+		}
+		return users.RevokeSessions(ctx, reset.Email, time.Now())
+	})
+	if err != nil {
+		return err
+	}
+	sessionUsers.forget(reset.Email)
+	return nil
+}
+
+// newSecureToken returns a random token to email to a user
+func newSecureToken() (string, error) {
+	b := make([]byte, secureTokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken returns the form an emailed token is stored in
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// ForgotPassword handles POST /password/forgot with {"email": "..."}. The
+// answer is the same, and as fast, whether or not the email belongs to an
+// account: the lookup and email happen after the response.
+func ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, r)
+		return
+	}
+	var request struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || strings.TrimSpace(request.Email) == "" {
+		writeError(w, r, Validation("invalid_body", "Email is required", FieldError{Field: "email", Message: "is required"}))
+		return
+	}
+
+	ctx := context.WithoutCancel(r.Context())
+	runInBackground(func() {
+		if err := RequestPasswordReset(ctx, request.Email); err != nil {
+			slog.ErrorContext(ctx, "Failed to send password reset", "err", err)
+		}
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "If an account exists for this email, a reset link has been sent to it.",
+	})
+}
+
+// ResetPasswordHandler handles POST /password/reset with
+// {"token": "...", "password": "..."}
+func ResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, r)
+		return
+	}
+	var request struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, r, errInvalidBody)
+		return
+	}
+
+	if err := ResetPassword(r.Context(), request.Token, request.Password); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Password reset")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,75 @@
+package microServerMainFiles
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log/slog"
+	"time"
+)
+
+// MongoPasswordResetRepository stores pending resets in the
+// password_resets collection
+type MongoPasswordResetRepository struct {
+	collection *mongo.Collection
+}
+
+// NewMongoPasswordResetRepository returns a PasswordResetRepository backed
+// by the password_resets collection of database
+func NewMongoPasswordResetRepository(database *mongo.Database) *MongoPasswordResetRepository {
+	return &MongoPasswordResetRepository{collection: database.Collection("password_resets")}
+}
+
+// InitPasswordResets creates the indexes for pending password resets: one
+// per token hash and email, removed by MongoDB once they expire
+func InitPasswordResets() error {
+	err := passwordResets.EnsureIndexes(context.TODO())
+	if err != nil {
+		slog.Error("Error creating password reset indexes", "err", err)
+	}
+	return err
+}
+
+func (r *MongoPasswordResetRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "token_hash", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "email", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	return err
+}
+
+func (r *MongoPasswordResetRepository) Create(ctx context.Context, reset PasswordReset) error {
+	_, err := r.collection.ReplaceOne(ctx, bson.M{"email": reset.Email}, reset, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (r *MongoPasswordResetRepository) Get(ctx context.Context, tokenHash string, now time.Time) (PasswordReset, error) {
+	var reset PasswordReset
+	err := r.collection.FindOne(ctx, bson.M{
+		"token_hash": tokenHash,
+		"expires_at": bson.M{"$gt": now},
+	}).Decode(&reset)
+	return reset, err
+}
+
+func (r *MongoPasswordResetRepository) Consume(ctx context.Context, tokenHash string) error {
+	result, err := r.collection.DeleteOne(ctx, bson.M{"token_hash": tokenHash})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package microServerMainFiles
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"log/slog"
+	"microService/pkg/payment"
+	"time"
+)
+
+// paymentTimeout bounds each call to the payment gateway
+const paymentTimeout = 30 * time.Second
+
+var paymentGateway payment.PaymentGateway = payment.NewSimulator()
+
+// SetPaymentGateway replaces the gateway used to charge cards. The default
+// is the in-process simulator.
+func SetPaymentGateway(gateway payment.PaymentGateway) {
+	paymentGateway = gateway
+}
+
+// chargeCard authorizes and captures amount on card, voiding the
+// authorization if the capture fails so no hold is left behind
+func chargeCard(ctx context.Context, amount float64, card payment.Card) (*payment.Authorization, error) {
+	ctx, cancel := context.WithTimeout(ctx, paymentTimeout)
+	defer cancel()
+
+	auth, err := paymentGateway.Authorize(ctx, amount, card)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := paymentGateway.Capture(ctx, auth.ID, amount); err != nil {
+		voidCtx, voidCancel := context.WithTimeout(context.WithoutCancel(ctx), paymentTimeout)
+		defer voidCancel()
+		if voidErr := paymentGateway.Void(voidCtx, auth.ID); voidErr != nil {
+			slog.ErrorContext(ctx, "Error voiding authorization after failed capture", "authorization_id", auth.ID, "err", voidErr)
+		}
+		return nil, err
+	}
+	return auth, nil
+}
+
+// refundPayment returns amount of a captured payment to the card
+func refundPayment(ctx context.Context, paymentID string, amount float64) error {
+	ctx, cancel := context.WithTimeout(ctx, paymentTimeout)
+	defer cancel()
+	return paymentGateway.Refund(ctx, paymentID, amount)
+}
+
+// compensatePayment undoes a captured payment whose transaction could not
+// be marked paid: the money is refunded and the transaction handed back so
+// the user can try again. Failures are logged, as the caller is already
+// answering with the error that made this necessary.
+func compensatePayment(ctx context.Context, transaction *Transaction, paymentID, actor string) {
+	slog.ErrorContext(ctx, "Payment captured but not settled, refunding it", "transaction_id", transaction.ID.Hex(), "payment_id", paymentID, "amount", transaction.TotalAmount)
+	if err := refundPayment(ctx, paymentID, transaction.TotalAmount); err != nil {
+		slog.ErrorContext(ctx, "Error refunding unsettled payment, refund it by hand", "transaction_id", transaction.ID.Hex(), "payment_id", paymentID, "err", err)
+	}
+	if _, err := UpdateTransactionStatus(ctx, transaction.ID, StatusPending, actor); err != nil {
+		slog.ErrorContext(ctx, "Error returning transaction to pending", "transaction_id", transaction.ID.Hex(), "err", err)
+	}
+}
+
+// recordPayment stores the gateway authorization that paid for a transaction
+// and the masked card it was charged to
+func recordPayment(ctx context.Context, transactionID primitive.ObjectID, paymentID string, method payment.MaskedCard) error {
+	err := transactions.SetPayment(ctx, transactionID, paymentID, method)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error recording payment", "transaction_id", transactionID.Hex(), "err", err)
+	}
+	return err
+}
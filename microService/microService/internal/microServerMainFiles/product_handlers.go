@@ -0,0 +1,249 @@
+package microServerMainFiles
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// legacyProductStock is the stock given to products created before stock was
+// tracked, the same as the seeded catalog starts with
+const legacyProductStock = 100
+
+// defaultProducts is the catalog the shop started with; it is seeded into an
+// empty products collection so a fresh database still has something to sell.
+var defaultProducts = []Product{
+	{ID: "1", Name: "Bread", Price: 110, Stock: legacyProductStock, ImageURL: "https://upload.wikimedia.org/wikipedia/commons/thumb/7/7b/Assorted_bread.jpg/411px-Assorted_bread.jpg"},
+	{ID: "2", Name: "Milk", Price: 165, Stock: legacyProductStock, ImageURL: "https://upload.wikimedia.org/wikipedia/commons/thumb/a/a5/Glass_of_Milk_%2833657535532%29.jpg/411px-Glass_of_Milk_%2833657535532%29.jpg"},
+	{ID: "3", Name: "Chocolate", Price: 320, Stock: legacyProductStock, ImageURL: "https://static6.depositphotos.com/1098692/603/i/450/depositphotos_6033070-stock-photo-chocolate.jpg"},
+}
+
+// InitProductCatalog creates the products indexes and seeds the default
+// catalog when there are no products
+func InitProductCatalog() error {
+	ctx := context.TODO()
+	if err := products.EnsureIndexes(ctx); err != nil {
+		slog.Error("Error creating products index", "err", err)
+		return err
+	}
+
+	existing, err := products.List(ctx)
+	if err != nil {
+		slog.Error("Error listing products", "err", err)
+		return err
+	}
+	if len(existing) > 0 {
+		return nil
+	}
+
+	for _, product := range defaultProducts {
+		product.UpdatedAt = time.Now()
+		if err := products.Insert(ctx, &product); err != nil {
+			slog.Error("Error seeding products", "product_id", product.ID, "err", err)
+			return err
+		}
+	}
+	slog.Info("Seeded default products", "count", len(defaultProducts))
+	return nil
+}
+
+// InitProductStock gives products stored before stock was tracked a stock
+// level; without one they read as out of stock and every checkout fails
+func InitProductStock() error {
+	migrated, err := products.BackfillStock(context.TODO(), legacyProductStock)
+	if err != nil {
+		slog.Error("Error migrating product stock", "err", err)
+		return err
+	}
+	if migrated > 0 {
+		slog.Info("Set stock on products without one", "count", migrated, "stock", legacyProductStock)
+	}
+	return nil
+}
+
+// ListPublicProducts returns the catalog without requiring a login
+func ListPublicProducts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, r)
+		return
+	}
+	listProducts(w, r)
+}
+
+// Products handles the /api/products collection: GET lists, POST creates
+func Products(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		listProducts(w, r)
+	case http.MethodPost:
+		if !isAdmin(r) {
+			writeError(w, r, errAdminRequired)
+			return
+		}
+		createProduct(w, r)
+	default:
+		writeMethodNotAllowed(w, r)
+	}
+}
+
+// ProductByID handles /api/products/{id}: GET reads, PUT replaces, DELETE removes
+func ProductByID(w http.ResponseWriter, r *http.Request) {
+	productID := strings.TrimPrefix(r.URL.Path, "/api/products/")
+	if productID == "" || strings.Contains(productID, "/") {
+		writeError(w, r, errProductIDRequired)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		product, err := RetrieveProduct(r.Context(), productID)
+		if err != nil {
+			writeProductLookupError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(product)
+	case http.MethodPut:
+		if !isAdmin(r) {
+			writeError(w, r, errAdminRequired)
+			return
+		}
+		updateProduct(w, r, productID)
+	case http.MethodDelete:
+		if !isAdmin(r) {
+			writeError(w, r, errAdminRequired)
+			return
+		}
+		if err := DeleteProduct(r.Context(), productID); err != nil {
+			writeProductLookupError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeMethodNotAllowed(w, r)
+	}
+}
+
+func listProducts(w http.ResponseWriter, r *http.Request) {
+	products, err := RetrieveProducts(r.Context())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(products)
+}
+
+func createProduct(w http.ResponseWriter, r *http.Request) {
+	var product Product
+	if err := json.NewDecoder(r.Body).Decode(&product); err != nil {
+		slog.WarnContext(r.Context(), "Error decoding product", "err", err)
+		writeError(w, r, errInvalidBody)
+		return
+	}
+	if fields := validateProduct(product); len(fields) > 0 {
+		writeError(w, r, Validation("invalid_product", "Invalid product", fields...))
+		return
+	}
+
+	if err := InsertProduct(r.Context(), &product); err != nil {
+		if err == ErrDuplicate {
+			err = Conflict("product_exists", "Product already exists")
+		}
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(product)
+}
+
+func updateProduct(w http.ResponseWriter, r *http.Request, productID string) {
+	var product Product
+	if err := json.NewDecoder(r.Body).Decode(&product); err != nil {
+		slog.WarnContext(r.Context(), "Error decoding product", "err", err)
+		writeError(w, r, errInvalidBody)
+		return
+	}
+	// The path is authoritative for the ID
+	product.ID = productID
+	if fields := validateProduct(product); len(fields) > 0 {
+		writeError(w, r, Validation("invalid_product", "Invalid product", fields...))
+		return
+	}
+
+	if err := ReplaceProduct(r.Context(), &product); err != nil {
+		writeProductLookupError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(product)
+}
+
+// validateProduct returns a FieldError for every field of product that
+// can't be stored
+func validateProduct(product Product) []FieldError {
+	var fields []FieldError
+	if strings.TrimSpace(product.ID) == "" {
+		fields = append(fields, FieldError{Field: "id", Message: "is required"})
+	}
+	if strings.TrimSpace(product.Name) == "" {
+		fields = append(fields, FieldError{Field: "name", Message: "is required"})
+	}
+	if product.Price <= 0 {
+		fields = append(fields, FieldError{Field: "price", Message: "must be positive"})
+	}
+	if product.Stock < 0 {
+		fields = append(fields, FieldError{Field: "stock", Message: "cannot be negative"})
+	}
+	return fields
+}
+
+func writeProductLookupError(w http.ResponseWriter, r *http.Request, err error) {
+	if err == ErrNotFound {
+		err = NotFound("product_not_found", "Product not found")
+	}
+	writeError(w, r, err)
+}
+
+// RetrieveProducts returns every product in the catalog ordered by ID
+func RetrieveProducts(ctx context.Context) ([]Product, error) {
+	list, err := products.List(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error finding products in database", "err", err)
+		return nil, err
+	}
+	return list, nil
+}
+
+// RetrieveProduct looks up a single product by its catalog ID
+func RetrieveProduct(ctx context.Context, productID string) (*Product, error) {
+	return products.Get(ctx, productID)
+}
+
+// InsertProduct adds a new product to the catalog, returning ErrDuplicate if
+// its ID is taken
+func InsertProduct(ctx context.Context, product *Product) error {
+	product.Reserved = 0
+	product.UpdatedAt = time.Now()
+	return products.Insert(ctx, product)
+}
+
+// ReplaceProduct overwrites the editable fields of an existing product,
+// returning ErrNotFound if it does not exist. Reserved stock is owned by
+// pending transactions and is left untouched.
+func ReplaceProduct(ctx context.Context, product *Product) error {
+	product.UpdatedAt = time.Now()
+	return products.Update(ctx, product)
+}
+
+// DeleteProduct removes a product from the catalog, returning ErrNotFound if
+// it does not exist
+func DeleteProduct(ctx context.Context, productID string) error {
+	return products.Delete(ctx, productID)
+}
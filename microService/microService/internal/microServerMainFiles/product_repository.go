@@ -0,0 +1,153 @@
+package microServerMainFiles
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log/slog"
+)
+
+// MongoProductRepository stores the catalog in the products collection
+type MongoProductRepository struct {
+	collection *mongo.Collection
+}
+
+// NewMongoProductRepository returns a ProductRepository backed by the
+// products collection of database
+func NewMongoProductRepository(database *mongo.Database) *MongoProductRepository {
+	return &MongoProductRepository{collection: database.Collection("products")}
+}
+
+func (r *MongoProductRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "id", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+func (r *MongoProductRepository) List(ctx context.Context) ([]Product, error) {
+	products := []Product{}
+	cursor, err := r.collection.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	if err = cursor.All(ctx, &products); err != nil {
+		return nil, err
+	}
+	return products, nil
+}
+
+func (r *MongoProductRepository) Get(ctx context.Context, productID string) (*Product, error) {
+	var product Product
+	if err := r.collection.FindOne(ctx, bson.M{"id": productID}).Decode(&product); err != nil {
+		return nil, err
+	}
+	return &product, nil
+}
+
+func (r *MongoProductRepository) Insert(ctx context.Context, product *Product) error {
+	_, err := r.collection.InsertOne(ctx, product)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicate
+	}
+	return err
+}
+
+func (r *MongoProductRepository) Update(ctx context.Context, product *Product) error {
+	result, err := r.collection.UpdateOne(ctx, bson.M{"id": product.ID}, bson.M{"$set": bson.M{
+		"name":        product.Name,
+		"price":       product.Price,
+		"description": product.Description,
+		"image_url":   product.ImageURL,
+		"stock":       product.Stock,
+		"updated_at":  product.UpdatedAt,
+	}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return r.collection.FindOne(ctx, bson.M{"id": product.ID}).Decode(product)
+}
+
+func (r *MongoProductRepository) Delete(ctx context.Context, productID string) error {
+	result, err := r.collection.DeleteOne(ctx, bson.M{"id": productID})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ReserveStock decrements each line only while enough stock is left. Lines
+// reserved before a failing one are not undone here; they roll back with the
+// surrounding MongoDB transaction.
+func (r *MongoProductRepository) ReserveStock(ctx context.Context, items []CartItem) error {
+	requested := make(map[string]int)
+	for _, item := range items {
+		requested[item.ProductID] += item.Quantity
+		result, err := r.collection.UpdateOne(
+			ctx,
+			bson.M{"id": item.ProductID, "stock": bson.M{"$gte": item.Quantity}},
+			bson.M{"$inc": bson.M{"stock": -item.Quantity, "reserved": item.Quantity}},
+		)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error reserving stock", "product_id", item.ProductID, "err", err)
+			return err
+		}
+		if result.MatchedCount == 0 {
+			return &InsufficientStockError{ProductID: item.ProductID, Requested: requested[item.ProductID]}
+		}
+	}
+	return nil
+}
+
+func (r *MongoProductRepository) ReleaseStock(ctx context.Context, items []CartItem) error {
+	return r.incEach(ctx, items, func(item CartItem) bson.M {
+		return bson.M{"stock": item.Quantity, "reserved": -item.Quantity}
+	})
+}
+
+func (r *MongoProductRepository) CommitStock(ctx context.Context, items []CartItem) error {
+	return r.incEach(ctx, items, func(item CartItem) bson.M {
+		return bson.M{"reserved": -item.Quantity}
+	})
+}
+
+func (r *MongoProductRepository) Restock(ctx context.Context, items []CartItem) error {
+	return r.incEach(ctx, items, func(item CartItem) bson.M {
+		return bson.M{"stock": item.Quantity}
+	})
+}
+
+func (r *MongoProductRepository) BackfillStock(ctx context.Context, stock int) (int64, error) {
+	result, err := r.collection.UpdateMany(ctx,
+		bson.M{"stock": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"stock": stock, "reserved": 0}},
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
+
+// incEach applies the $inc built by inc to the product of every item
+func (r *MongoProductRepository) incEach(ctx context.Context, items []CartItem, inc func(CartItem) bson.M) error {
+	for _, item := range items {
+		_, err := r.collection.UpdateOne(
+			ctx,
+			bson.M{"id": item.ProductID},
+			bson.M{"$inc": inc(item)},
+		)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error updating stock", "product_id", item.ProductID, "err", err)
+			return err
+		}
+	}
+	return nil
+}
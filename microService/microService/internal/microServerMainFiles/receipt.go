@@ -2,10 +2,12 @@ package microServerMainFiles
 
 import (
 	"bytes"
+	"context"
 	"fmt"
-	"log"
+	"log/slog"
 
 	"github.com/signintech/gopdf"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type ReceiptData struct {
@@ -26,23 +28,40 @@ type ReceiptItem struct {
 	Total    string
 }
 
-func GenerateReceiptPDF(transaction *Transaction, customerName string) ([]byte, error) {
+// Shop details printed at the top of every receipt and credit note
+const (
+	receiptFontPath = "internal/microServerMainFiles/arial.ttf"
+	shopTIN         = "123456789"
+	shopProject     = "Book Shop"
+)
+
+// document is what a receipt or credit note prints: the shared header, a
+// title, detail lines, a table of items and closing lines such as totals
+type document struct {
+	Title   string
+	Details []string
+	Items   []CartItem
+	// Credit shows item totals as money going back to the customer
+	Credit bool
+	Totals []string
+	Footer []string
+}
+
+// render lays out the document on an A4 page and returns the PDF
+func (d document) render(ctx context.Context) ([]byte, error) {
 	pdf := gopdf.GoPdf{}
 	pdf.Start(gopdf.Config{PageSize: gopdf.Rect{W: 210, H: 297}}) // A4 size in mm
 	pdf.AddPage()
 
-	// Add Arial font
-	fontPath := "internal/microServerMainFiles/arial.ttf"
-	err := pdf.AddTTFFont("arial", fontPath)
+	err := pdf.AddTTFFont("arial", receiptFontPath)
 	if err != nil {
-		log.Printf("Error adding font: %v", err)
+		slog.ErrorContext(ctx, "Error adding font", "err", err)
 		return nil, err
 	}
 
-	// Set font size to smaller
 	err = pdf.SetFont("arial", "", 8)
 	if err != nil {
-		log.Printf("Error setting font: %v", err)
+		slog.ErrorContext(ctx, "Error setting font", "err", err)
 		return nil, err
 	}
 
@@ -51,32 +70,30 @@ func GenerateReceiptPDF(transaction *Transaction, customerName string) ([]byte,
 	lineHeight := 10.0
 	textWidth := 190.0
 
-	// Function to draw text
 	drawText := func(text string, y float64, x float64) {
 		pdf.SetX(x)
 		pdf.SetY(y)
 		pdf.CellWithOption(&gopdf.Rect{W: textWidth, H: lineHeight}, text, gopdf.CellOption{Align: gopdf.Left})
 	}
+	drawLines := func(lines []string, y float64) float64 {
+		for i, line := range lines {
+			if i > 0 {
+				y += lineHeight
+			}
+			drawText(line, y, marginLeft)
+		}
+		return y
+	}
 
 	// Header
 	currentY := 20.0
-	drawText("TIN: 123456789", currentY, marginLeft)
+	drawText("TIN: "+shopTIN, currentY, marginLeft)
 	currentY += lineHeight
-	drawText("Welcome to our shop", currentY, marginLeft)
+	drawText(d.Title, currentY, marginLeft)
 
-	// Transaction details
+	// Details
 	currentY += 2 * lineHeight
-	drawText(fmt.Sprintf("Project: %s", "Book Shop"), currentY, marginLeft)
-	currentY += lineHeight
-	drawText(fmt.Sprintf("Transaction #: %s", transaction.ID.Hex()), currentY, marginLeft)
-	currentY += lineHeight
-	drawText(fmt.Sprintf("Date: %s", transaction.CreatedAt.Format("2006-01-02")), currentY, marginLeft)
-	currentY += lineHeight
-	drawText(fmt.Sprintf("Time: %s", transaction.CreatedAt.Format("15:04:05")), currentY, marginLeft)
-	currentY += lineHeight
-	drawText(fmt.Sprintf("Customer: %s", customerName), currentY, marginLeft)
-	currentY += lineHeight
-	drawText(fmt.Sprintf("Payment Method: %s", "Credit Card"), currentY, marginLeft)
+	currentY = drawLines(append([]string{fmt.Sprintf("Project: %s", shopProject)}, d.Details...), currentY)
 
 	// Table header
 	currentY += 2 * lineHeight
@@ -85,32 +102,82 @@ func GenerateReceiptPDF(transaction *Transaction, customerName string) ([]byte,
 	drawText("Quantity", currentY, marginLeft+110)
 	drawText("Total", currentY, marginLeft+160)
 
-	for _, item := range transaction.Items {
+	sign := ""
+	if d.Credit {
+		sign = "-"
+	}
+	for _, item := range d.Items {
 		total := item.Price * float64(item.Quantity)
 		currentY += lineHeight
 		drawText(item.ProductID, currentY, marginLeft)
 		drawText(fmt.Sprintf("$%.2f", item.Price), currentY, marginLeft+60)
 		drawText(fmt.Sprintf("%d", item.Quantity), currentY, marginLeft+110)
-		drawText(fmt.Sprintf("$%.2f", total), currentY, marginLeft+160)
+		drawText(fmt.Sprintf("%s$%.2f", sign, total), currentY, marginLeft+160)
 	}
 
-	// Grand total
 	currentY += 2 * lineHeight
-	drawText(fmt.Sprintf("Grand Total: $%.2f", transaction.TotalAmount), currentY, marginLeft)
+	currentY = drawLines(d.Totals, currentY)
 
-	// Footer
-	currentY += 2 * lineHeight
-	drawText("THANK YOU", currentY, marginLeft)
-	currentY += lineHeight
-	drawText("COME BACK AGAIN", currentY, marginLeft)
-	currentY += lineHeight
+	if len(d.Footer) > 0 {
+		currentY += 2 * lineHeight
+		drawLines(d.Footer, currentY)
+	}
 
 	var pdfBuf bytes.Buffer
 	err = pdf.Write(&pdfBuf)
 	if err != nil {
-		log.Printf("Error writing PDF: %v", err)
+		slog.ErrorContext(ctx, "Error writing PDF", "err", err)
 		return nil, err
 	}
 
 	return pdfBuf.Bytes(), nil
 }
+
+func GenerateReceiptPDF(ctx context.Context, transaction *Transaction, customerName string) ([]byte, error) {
+	ctx, span := startSpan(ctx, "GenerateReceiptPDF", attribute.String("transaction.id", transaction.ID.Hex()))
+	var err error
+	defer func() { endSpan(span, err) }()
+
+	paymentMethod := "Credit Card"
+	if transaction.PaymentMethod != nil {
+		paymentMethod = transaction.PaymentMethod.String()
+	}
+	pdf, err := document{
+		Title: "Welcome to our shop",
+		Details: []string{
+			fmt.Sprintf("Transaction #: %s", transaction.ID.Hex()),
+			fmt.Sprintf("Date: %s", transaction.CreatedAt.Format("2006-01-02")),
+			fmt.Sprintf("Time: %s", transaction.CreatedAt.Format("15:04:05")),
+			fmt.Sprintf("Customer: %s", customerName),
+			fmt.Sprintf("Payment Method: %s", paymentMethod),
+		},
+		Items:  transaction.Items,
+		Totals: []string{fmt.Sprintf("Grand Total: $%.2f", transaction.TotalAmount)},
+		Footer: []string{"THANK YOU", "COME BACK AGAIN"},
+	}.render(ctx)
+	return pdf, err
+}
+
+func GenerateCreditNotePDF(ctx context.Context, transaction *Transaction, refund *Refund) ([]byte, error) {
+	ctx, span := startSpan(ctx, "GenerateCreditNotePDF", attribute.String("transaction.id", transaction.ID.Hex()))
+	var err error
+	defer func() { endSpan(span, err) }()
+
+	details := []string{
+		fmt.Sprintf("Credit Note #: %s", refund.ID.Hex()),
+		fmt.Sprintf("Original Transaction #: %s", transaction.ID.Hex()),
+		fmt.Sprintf("Date: %s", refund.CreatedAt.Format("2006-01-02")),
+		fmt.Sprintf("Time: %s", refund.CreatedAt.Format("15:04:05")),
+	}
+	if transaction.PaymentMethod != nil {
+		details = append(details, fmt.Sprintf("Refunded To: %s", transaction.PaymentMethod.String()))
+	}
+	pdf, err := document{
+		Title:   "CREDIT NOTE",
+		Details: details,
+		Items:   refund.Items,
+		Credit:  true,
+		Totals:  []string{fmt.Sprintf("Total Refunded: $%.2f", refund.Amount)},
+	}.render(ctx)
+	return pdf, err
+}
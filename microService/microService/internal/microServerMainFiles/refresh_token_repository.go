@@ -0,0 +1,113 @@
+package microServerMainFiles
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log/slog"
+	"time"
+)
+
+// MongoRefreshTokenRepository stores refresh tokens in the refresh_tokens
+// collection
+type MongoRefreshTokenRepository struct {
+	collection *mongo.Collection
+}
+
+// NewMongoRefreshTokenRepository returns a RefreshTokenRepository backed by
+// the refresh_tokens collection of database
+func NewMongoRefreshTokenRepository(database *mongo.Database) *MongoRefreshTokenRepository {
+	return &MongoRefreshTokenRepository{collection: database.Collection("refresh_tokens")}
+}
+
+// InitRefreshTokens creates the indexes for refresh tokens: one per token
+// hash, looked up by family or user, removed by MongoDB once they expire
+func InitRefreshTokens() error {
+	err := refreshTokens.EnsureIndexes(context.TODO())
+	if err != nil {
+		slog.Error("Error creating refresh token indexes", "err", err)
+	}
+	return err
+}
+
+func (r *MongoRefreshTokenRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "token_hash", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "family", Value: 1}},
+		},
+		{
+			Keys: bson.D{{Key: "email", Value: 1}, {Key: "session_start", Value: -1}},
+		},
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	return err
+}
+
+func (r *MongoRefreshTokenRepository) Create(ctx context.Context, token RefreshToken) error {
+	_, err := r.collection.InsertOne(ctx, token)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicate
+	}
+	return err
+}
+
+func (r *MongoRefreshTokenRepository) Get(ctx context.Context, tokenHash string) (RefreshToken, error) {
+	var token RefreshToken
+	err := r.collection.FindOne(ctx, bson.M{"token_hash": tokenHash}).Decode(&token)
+	return token, err
+}
+
+func (r *MongoRefreshTokenRepository) MarkUsed(ctx context.Context, tokenHash string, at time.Time) error {
+	result, err := r.collection.UpdateOne(ctx,
+		bson.M{"token_hash": tokenHash, "used_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"used_at": at}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *MongoRefreshTokenRepository) RevokeFamily(ctx context.Context, family string, at time.Time) error {
+	_, err := r.collection.UpdateMany(ctx,
+		bson.M{"family": family, "revoked_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revoked_at": at}},
+	)
+	return err
+}
+
+func (r *MongoRefreshTokenRepository) ListFamily(ctx context.Context, family string) ([]RefreshToken, error) {
+	return r.find(ctx, bson.M{"family": family}, bson.D{{Key: "created_at", Value: 1}})
+}
+
+func (r *MongoRefreshTokenRepository) ListActive(ctx context.Context, email string, now time.Time) ([]RefreshToken, error) {
+	return r.find(ctx, bson.M{
+		"email":      email,
+		"used_at":    bson.M{"$exists": false},
+		"revoked_at": bson.M{"$exists": false},
+		"expires_at": bson.M{"$gt": now},
+	}, bson.D{{Key: "session_start", Value: -1}})
+}
+
+func (r *MongoRefreshTokenRepository) find(ctx context.Context, filter bson.M, sort bson.D) ([]RefreshToken, error) {
+	cursor, err := r.collection.Find(ctx, filter, options.Find().SetSort(sort))
+	if err != nil {
+		return nil, err
+	}
+	tokens := []RefreshToken{}
+	if err := cursor.All(ctx, &tokens); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
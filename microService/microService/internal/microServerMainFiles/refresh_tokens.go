@@ -0,0 +1,262 @@
+package microServerMainFiles
+
+import (
+	"context"
+	"encoding/json"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+// RefreshToken is a single use token that renews an access token. Only the
+// SHA-256 hash of the token is stored. Using one replaces it with a new
+// token in the same family; using one a second time means it was stolen,
+// so the whole family is revoked. A family is what users see as a session.
+type RefreshToken struct {
+	TokenHash string    `bson:"token_hash"`
+	Family    string    `bson:"family"`
+	Email     string    `bson:"email"`
+	CreatedAt time.Time `bson:"created_at"`
+	ExpiresAt time.Time `bson:"expires_at"`
+	UsedAt    time.Time `bson:"used_at,omitempty"`
+	RevokedAt time.Time `bson:"revoked_at,omitempty"`
+	// SessionStart is when the user logged in. UserAgent and IP are those
+	// of the client the token was issued to, and AccessTokenID the jti of
+	// the access token issued with it.
+	SessionStart  time.Time `bson:"session_start"`
+	UserAgent     string    `bson:"user_agent"`
+	IP            string    `bson:"ip"`
+	AccessTokenID string    `bson:"access_token_id"`
+}
+
+// SessionClient describes the client a session's tokens are issued to
+type SessionClient struct {
+	UserAgent string
+	IP        string
+}
+
+// sessionClient returns the client that sent r. Behind a proxy the IP is
+// that of the proxy.
+func sessionClient(r *http.Request) SessionClient {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return SessionClient{UserAgent: r.UserAgent(), IP: ip}
+}
+
+// TokenPair is the answer to a login or refresh
+type TokenPair struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+var (
+	// errInvalidRefreshToken covers unknown, expired and revoked tokens alike
+	errInvalidRefreshToken = Unauthorized("invalid_refresh_token", "Refresh token is invalid or has expired, please log in again")
+	errRefreshTokenReused  = Unauthorized("refresh_token_reused", "Refresh token was already used, please log in again")
+)
+
+// StartSession issues the first access and refresh tokens for user, in a
+// new family
+func StartSession(ctx context.Context, user UserCredentials, client SessionClient) (TokenPair, error) {
+	now := time.Now()
+	return issueTokens(ctx, user, RefreshToken{Family: primitive.NewObjectID().Hex(), SessionStart: now}, client, now)
+}
+
+// RefreshSession exchanges refreshToken for a new access token and a new
+// refresh token in the same family. Presenting a token that was already
+// exchanged revokes its family, logging out both the thief and the user.
+func RefreshSession(ctx context.Context, refreshToken string, client SessionClient) (TokenPair, error) {
+	now := time.Now()
+	tokenHash := hashToken(refreshToken)
+	stored, err := refreshTokens.Get(ctx, tokenHash)
+	if err == ErrNotFound {
+		return TokenPair{}, errInvalidRefreshToken
+	}
+	if err != nil {
+		return TokenPair{}, err
+	}
+	if !stored.RevokedAt.IsZero() || !stored.ExpiresAt.After(now) {
+		return TokenPair{}, errInvalidRefreshToken
+	}
+	if !stored.UsedAt.IsZero() {
+		return TokenPair{}, revokeReusedFamily(ctx, stored)
+	}
+
+	user, err := users.GetByEmail(ctx, stored.Email)
+	if err == ErrNotFound {
+		return TokenPair{}, errInvalidRefreshToken
+	}
+	if err != nil {
+		return TokenPair{}, err
+	}
+	// Sessions revoked after this token was issued, e.g. by a password reset
+	if !user.SessionsValidAfter.IsZero() && !stored.CreatedAt.After(user.SessionsValidAfter) {
+		return TokenPair{}, errInvalidRefreshToken
+	}
+
+	var pair TokenPair
+	err = transactor.WithTransaction(ctx, func(ctx context.Context) error {
+		// Whoever marks the token used first gets the new pair
+		if err := refreshTokens.MarkUsed(ctx, tokenHash, now); err != nil {
+			return err
+		}
+		var err error
+		pair, err = issueTokens(ctx, user, stored, client, now)
+		return err
+	})
+	if err == ErrNotFound {
+		return TokenPair{}, revokeReusedFamily(ctx, stored)
+	}
+	return pair, err
+}
+
+// EndSession revokes the family of refreshToken and the access tokens
+// issued with it. Unknown tokens are ignored, so logging out twice is not
+// an error.
+func EndSession(ctx context.Context, refreshToken string) error {
+	stored, err := refreshTokens.Get(ctx, hashToken(refreshToken))
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return revokeSession(ctx, stored.Family)
+}
+
+// revokeSession revokes every refresh token in family and every access
+// token issued with them that has not expired yet
+func revokeSession(ctx context.Context, family string) error {
+	now := time.Now()
+	if err := refreshTokens.RevokeFamily(ctx, family, now); err != nil {
+		return err
+	}
+	tokens, err := refreshTokens.ListFamily(ctx, family)
+	if err != nil {
+		return err
+	}
+	for _, token := range tokens {
+		// Access tokens are signed with the refresh token they came with
+		expiresAt := token.CreatedAt.Add(jwtTTL)
+		if token.AccessTokenID == "" || !expiresAt.After(now) {
+			continue
+		}
+		if err := revokeAccessToken(ctx, token.AccessTokenID, expiresAt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// revokeReusedFamily revokes the family of a refresh token presented after
+// it was already exchanged
+func revokeReusedFamily(ctx context.Context, stored RefreshToken) error {
+	slog.WarnContext(ctx, "Refresh token reused, revoking its family", "user", stored.Email, "family", stored.Family)
+	if err := revokeSession(ctx, stored.Family); err != nil {
+		return err
+	}
+	return errRefreshTokenReused
+}
+
+// issueTokens signs an access token for user and stores a new refresh token
+// in the family, and session, of previous
+func issueTokens(ctx context.Context, user UserCredentials, previous RefreshToken, client SessionClient, now time.Time) (TokenPair, error) {
+	accessTokenID := primitive.NewObjectID().Hex()
+	accessToken, err := GenerateJWT(user.Email, user.Role, previous.Family, accessTokenID)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	refreshToken, err := newSecureToken()
+	if err != nil {
+		return TokenPair{}, err
+	}
+	err = refreshTokens.Create(ctx, RefreshToken{
+		TokenHash:     hashToken(refreshToken),
+		Family:        previous.Family,
+		Email:         user.Email,
+		CreatedAt:     now,
+		ExpiresAt:     now.Add(refreshTokenTTL),
+		SessionStart:  previous.SessionStart,
+		UserAgent:     client.UserAgent,
+		IP:            client.IP,
+		AccessTokenID: accessTokenID,
+	})
+	if err != nil {
+		return TokenPair{}, err
+	}
+	return TokenPair{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(jwtTTL / time.Second),
+		RefreshToken: refreshToken,
+	}, nil
+}
+
+// writeTokenPair answers with pair, also putting the access token in the
+// Authorization header as login always has
+func writeTokenPair(w http.ResponseWriter, pair TokenPair) {
+	w.Header().Set("Authorization", "Bearer "+pair.AccessToken)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(pair)
+}
+
+// decodeRefreshToken reads {"refresh_token": "..."} from the body of r
+func decodeRefreshToken(r *http.Request) (string, error) {
+	var request struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.RefreshToken == "" {
+		return "", Validation("invalid_body", "Refresh token is required", FieldError{Field: "refresh_token", Message: "is required"})
+	}
+	return request.RefreshToken, nil
+}
+
+// RefreshTokenHandler handles POST /token/refresh with
+// {"refresh_token": "..."} and answers with a new token pair. The refresh
+// token sent can't be used again.
+func RefreshTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, r)
+		return
+	}
+	refreshToken, err := decodeRefreshToken(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	pair, err := RefreshSession(detachedContext(r), refreshToken, sessionClient(r))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeTokenPair(w, pair)
+}
+
+// Logout handles POST /logout with {"refresh_token": "..."}, revoking it,
+// every refresh token it was renewed from or into and their access tokens
+func Logout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, r)
+		return
+	}
+	refreshToken, err := decodeRefreshToken(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if err := EndSession(r.Context(), refreshToken); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	slog.InfoContext(r.Context(), "User logged out")
+	w.WriteHeader(http.StatusNoContent)
+}
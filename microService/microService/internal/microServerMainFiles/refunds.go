@@ -0,0 +1,252 @@
+package microServerMainFiles
+
+import (
+	"context"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"log/slog"
+	"math"
+	"microService/pkg/email"
+	"time"
+)
+
+var (
+	// ErrNothingToRefund is returned when every unit of a transaction has
+	// already been refunded
+	ErrNothingToRefund = Conflict("nothing_to_refund", "Nothing left to refund")
+	// ErrRefundConflict is returned when another refund was recorded against
+	// the transaction while this one was being prepared
+	ErrRefundConflict = Conflict("refund_conflict", "Transaction was refunded concurrently")
+)
+
+// RefundLineError describes a requested refund line that can't be honoured
+type RefundLineError struct {
+	ProductID string
+	Message   string
+}
+
+func (e *RefundLineError) Error() string {
+	return fmt.Sprintf("product %s: %s", e.ProductID, e.Message)
+}
+
+// RefundLine asks for a quantity of one product to be refunded
+type RefundLine struct {
+	ProductID string `json:"product_id"`
+	Quantity  int    `json:"quantity"`
+}
+
+// RetrieveTransaction looks up a transaction by ID
+func RetrieveTransaction(ctx context.Context, transactionID primitive.ObjectID) (*Transaction, error) {
+	return transactions.Get(ctx, transactionID)
+}
+
+// refundableQuantities returns, per product, how many units of the
+// transaction have not been refunded yet
+func refundableQuantities(transaction *Transaction) map[string]int {
+	remaining := make(map[string]int)
+	for _, item := range transaction.Items {
+		remaining[item.ProductID] += item.Quantity
+	}
+	for _, refund := range transaction.Refunds {
+		for _, item := range refund.Items {
+			remaining[item.ProductID] -= item.Quantity
+		}
+	}
+	return remaining
+}
+
+// unitPrices returns the price paid per unit of each product
+func unitPrices(transaction *Transaction) map[string]float64 {
+	prices := make(map[string]float64)
+	for _, item := range transaction.Items {
+		prices[item.ProductID] = item.Price
+	}
+	return prices
+}
+
+// RefundTransaction refunds lines of a paid transaction, or everything not
+// yet refunded when lines is empty. It records the refund, returns the money
+// through the payment gateway, restocks the items if the transaction took
+// stock and moves the transaction to refunded once nothing is left. The
+// credit note email is sent in the background on a best effort basis: a
+// failed email doesn't undo the refund.
+func RefundTransaction(ctx context.Context, transaction *Transaction, lines []RefundLine, actor string) (*Refund, error) {
+	if transaction.Status != StatusPaid && transaction.Status != StatusFulfilled {
+		return nil, &IllegalTransitionError{From: transaction.Status, To: StatusRefunded}
+	}
+
+	remaining := refundableQuantities(transaction)
+	prices := unitPrices(transaction)
+
+	if len(lines) == 0 {
+		seen := make(map[string]bool)
+		for _, item := range transaction.Items {
+			if qty := remaining[item.ProductID]; qty > 0 && !seen[item.ProductID] {
+				lines = append(lines, RefundLine{ProductID: item.ProductID, Quantity: qty})
+				seen[item.ProductID] = true
+			}
+		}
+		if len(lines) == 0 {
+			return nil, ErrNothingToRefund
+		}
+	}
+
+	refund := &Refund{
+		ID:        primitive.NewObjectID(),
+		Actor:     actor,
+		CreatedAt: time.Now(),
+	}
+	requested := make(map[string]int)
+	for _, line := range lines {
+		if line.Quantity <= 0 {
+			return nil, &RefundLineError{ProductID: line.ProductID, Message: "quantity must be positive"}
+		}
+		price, ok := prices[line.ProductID]
+		if !ok {
+			return nil, &RefundLineError{ProductID: line.ProductID, Message: "not part of this transaction"}
+		}
+		requested[line.ProductID] += line.Quantity
+		if requested[line.ProductID] > remaining[line.ProductID] {
+			return nil, &RefundLineError{ProductID: line.ProductID, Message: fmt.Sprintf("only %d left to refund", remaining[line.ProductID])}
+		}
+		refund.Items = append(refund.Items, CartItem{ProductID: line.ProductID, Quantity: line.Quantity, Price: price})
+	}
+	refund.Amount = math.Round(CalculateTotal(refund.Items)*100) / 100
+
+	fullyRefunded := true
+	for productID, qty := range remaining {
+		if qty-requested[productID] > 0 {
+			fullyRefunded = false
+		}
+	}
+
+	// Record the refund first, conditional on no other refund having been
+	// recorded since we read the transaction, so two concurrent partial
+	// refunds can't both pass the quantity check
+	recorded, err := transactions.AddRefund(ctx, transaction.ID, transaction.Status, len(transaction.Refunds), *refund)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error recording refund", "transaction_id", transaction.ID.Hex(), "err", err)
+		return nil, err
+	}
+	if !recorded {
+		return nil, ErrRefundConflict
+	}
+
+	// Transactions paid before the gateway existed were never charged, so
+	// there is nothing to send back
+	if transaction.PaymentID != "" {
+		if err := refundPayment(ctx, transaction.PaymentID, refund.Amount); err != nil {
+			if pullErr := transactions.RemoveRefund(ctx, transaction.ID, refund.ID); pullErr != nil {
+				slog.ErrorContext(ctx, "Error removing failed refund", "refund_id", refund.ID.Hex(), "err", pullErr)
+			}
+			return nil, err
+		}
+	}
+
+	// Transactions placed before stock was tracked never took any
+	if transaction.StockReserved {
+		if err := RestockItems(ctx, refund.Items); err != nil {
+			slog.ErrorContext(ctx, "Error restocking refund", "refund_id", refund.ID.Hex(), "err", err)
+		}
+	}
+
+	if fullyRefunded {
+		if _, err := UpdateTransactionStatus(ctx, transaction.ID, StatusRefunded, actor); err != nil {
+			slog.ErrorContext(ctx, "Error marking transaction refunded", "transaction_id", transaction.ID.Hex(), "err", err)
+		}
+	}
+
+	// The caller already has its answer; the email goes out afterwards
+	emailCtx := context.WithoutCancel(ctx)
+	runInBackground(func() { sendCreditNote(emailCtx, transaction, refund) })
+	return refund, nil
+}
+
+// CancelTransaction cancels a pending transaction and releases its stock
+func CancelTransaction(ctx context.Context, transaction *Transaction, actor string) (*Transaction, error) {
+	if transaction.Status != StatusPending {
+		return nil, &IllegalTransitionError{From: transaction.Status, To: StatusCancelled}
+	}
+
+	cancelled, err := UpdateTransactionStatus(ctx, transaction.ID, StatusCancelled, actor)
+	if err != nil {
+		return nil, err
+	}
+
+	if cancelled.StockReserved {
+		if err := ReleaseStock(ctx, cancelled.Items); err != nil {
+			slog.ErrorContext(ctx, "Error releasing stock for cancelled transaction", "transaction_id", cancelled.ID.Hex(), "err", err)
+		}
+	}
+	return cancelled, nil
+}
+
+// VoidTransaction cancels a pending transaction and marks it voided so it
+// no longer shows up for the user. The document is kept for accounting.
+// Cancelling, releasing the stock and marking it voided run in a single
+// transaction, so a transaction is never left cancelled but not voided.
+func VoidTransaction(ctx context.Context, transaction *Transaction, actor string) (*Transaction, error) {
+	var voided *Transaction
+	now := time.Now()
+	err := transactor.WithTransaction(ctx, func(ctx context.Context) error {
+		cancelled, err := CancelTransaction(ctx, transaction, actor)
+		if err != nil {
+			return err
+		}
+		if err := transactions.MarkVoided(ctx, cancelled.ID, now, actor); err != nil {
+			slog.ErrorContext(ctx, "Error marking transaction voided", "transaction_id", cancelled.ID.Hex(), "err", err)
+			return err
+		}
+		voided = cancelled
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	voided.VoidedAt = &now
+	voided.VoidedBy = actor
+
+	RecordAudit(ctx, "void", actor, voided)
+	return voided, nil
+}
+
+// PurgeTransaction permanently deletes a transaction. It exists to clean up
+// test data; the audit log keeps a record that the transaction existed.
+func PurgeTransaction(ctx context.Context, transaction *Transaction, actor string) error {
+	if err := transactions.Delete(ctx, transaction.ID); err != nil {
+		if err != ErrNotFound {
+			slog.ErrorContext(ctx, "Error purging transaction", "transaction_id", transaction.ID.Hex(), "err", err)
+		}
+		return err
+	}
+
+	// A purged unpaid transaction no longer holds its stock. If a payment
+	// for it is being charged, that payment can no longer be marked paid
+	// and is refunded.
+	unpaid := transaction.Status == StatusPending || transaction.Status == StatusAwaitingPayment
+	if unpaid && transaction.StockReserved {
+		if err := ReleaseStock(ctx, transaction.Items); err != nil {
+			slog.ErrorContext(ctx, "Error releasing stock for purged transaction", "transaction_id", transaction.ID.Hex(), "err", err)
+		}
+	}
+
+	RecordAudit(ctx, "purge", actor, transaction)
+	return nil
+}
+
+func sendCreditNote(ctx context.Context, transaction *Transaction, refund *Refund) {
+	pdf, err := GenerateCreditNotePDF(ctx, transaction, refund)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to generate credit note PDF", "transaction_id", transaction.ID.Hex(), "err", err)
+		return
+	}
+	receiptsGenerated.WithLabelValues("credit_note").Inc()
+
+	body := fmt.Sprintf("We have refunded $%.2f for transaction %s.", refund.Amount, transaction.ID.Hex())
+	err = email.SendEmailWithAttachment(transaction.UserID, "Your Credit Note", body, "credit_note.pdf", pdf)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to send credit note email", "transaction_id", transaction.ID.Hex(), "err", err)
+		return
+	}
+	slog.InfoContext(ctx, "Credit note sent", "transaction_id", transaction.ID.Hex(), "user", transaction.UserID)
+}
@@ -0,0 +1,225 @@
+package microServerMainFiles
+
+import (
+	"context"
+	"errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"microService/pkg/payment"
+	"time"
+)
+
+// ErrNotFound is returned by repositories when the requested document does
+// not exist. It is mongo.ErrNoDocuments so callers written against the
+// driver keep working with every implementation.
+var ErrNotFound = mongo.ErrNoDocuments
+
+// ErrDuplicate is returned when inserting a document whose unique key is
+// already taken
+var ErrDuplicate = errors.New("duplicate key")
+
+// UserRepository stores user credentials
+type UserRepository interface {
+	// EnsureIndexes creates the indexes the repository relies on, failing
+	// if stored users share an email
+	EnsureIndexes(ctx context.Context) error
+	// VerifyLegacyUsers marks users stored before email verification
+	// existed as verified and returns how many there were
+	VerifyLegacyUsers(ctx context.Context) (int64, error)
+	Save(ctx context.Context, user UserCredentials) error
+	GetByEmail(ctx context.Context, email string) (UserCredentials, error)
+	// UpdatePassword replaces the stored password hash, returning
+	// ErrNotFound if there is no user with email
+	UpdatePassword(ctx context.Context, email, passwordHash string) error
+	// RevokeSessions makes tokens issued to the user before at invalid,
+	// returning ErrNotFound if there is no user with email
+	RevokeSessions(ctx context.Context, email string, at time.Time) error
+	// SetVerificationToken stores the hash of the token emailed to verify
+	// the user's address, replacing any earlier one
+	SetVerificationToken(ctx context.Context, email, tokenHash string, expiresAt time.Time) error
+	// VerifyEmail marks the address whose unexpired token hashes to
+	// tokenHash as verified and forgets the token. It returns the address,
+	// or ErrNotFound if no such token is pending.
+	VerifyEmail(ctx context.Context, tokenHash string, now time.Time) (string, error)
+}
+
+// PasswordResetRepository stores pending password resets by the hash of
+// their token
+type PasswordResetRepository interface {
+	// EnsureIndexes creates the indexes the repository relies on
+	EnsureIndexes(ctx context.Context) error
+	// Create stores reset, replacing any earlier reset for the same email
+	Create(ctx context.Context, reset PasswordReset) error
+	// Get returns the reset for tokenHash if it has not expired as of now
+	Get(ctx context.Context, tokenHash string, now time.Time) (PasswordReset, error)
+	// Consume deletes the reset for tokenHash, returning ErrNotFound if it
+	// is already gone, so only one caller can use it
+	Consume(ctx context.Context, tokenHash string) error
+}
+
+// RefreshTokenRepository stores refresh tokens by the hash of their token.
+// The tokens that replaced each other since one login form a family.
+type RefreshTokenRepository interface {
+	// EnsureIndexes creates the indexes the repository relies on
+	EnsureIndexes(ctx context.Context) error
+	Create(ctx context.Context, token RefreshToken) error
+	// Get returns the token for tokenHash, even if it is used, revoked or
+	// expired, so reuse can be told apart from a made up token
+	Get(ctx context.Context, tokenHash string) (RefreshToken, error)
+	// MarkUsed records that the token for tokenHash was exchanged at at,
+	// returning ErrNotFound if it already was, so only one caller can use it
+	MarkUsed(ctx context.Context, tokenHash string, at time.Time) error
+	// RevokeFamily revokes every token in family
+	RevokeFamily(ctx context.Context, family string, at time.Time) error
+	// ListFamily returns every token in family, oldest first
+	ListFamily(ctx context.Context, family string) ([]RefreshToken, error)
+	// ListActive returns the tokens of email that can still be used as of
+	// now, one per family, newest session first
+	ListActive(ctx context.Context, email string, now time.Time) ([]RefreshToken, error)
+}
+
+// RevokedTokenRepository stores the IDs of revoked access tokens until they
+// would have expired anyway
+type RevokedTokenRepository interface {
+	// EnsureIndexes creates the indexes the repository relies on
+	EnsureIndexes(ctx context.Context) error
+	// Revoke stores token; revoking a token twice is not an error
+	Revoke(ctx context.Context, token RevokedToken) error
+	IsRevoked(ctx context.Context, tokenID string) (bool, error)
+}
+
+// IdempotencyKeyRepository stores the requests seen with an
+// Idempotency-Key, one per user and key
+type IdempotencyKeyRepository interface {
+	// EnsureIndexes creates the indexes the repository relies on
+	EnsureIndexes(ctx context.Context) error
+	// Claim stores record unless its key is already held, and reports
+	// whether it did. A record for the key created before staleBefore is
+	// replaced.
+	Claim(ctx context.Context, record IdempotencyRecord, staleBefore time.Time) (bool, error)
+	Get(ctx context.Context, userID, key string) (IdempotencyRecord, error)
+	// Complete stores the response the request with the key produced
+	Complete(ctx context.Context, userID, key string, statusCode int, contentType string, body []byte) error
+	// Release forgets the key so the request can be tried again
+	Release(ctx context.Context, userID, key string) error
+}
+
+// ProductRepository stores the catalog and its stock levels
+type ProductRepository interface {
+	// EnsureIndexes creates the indexes the repository relies on
+	EnsureIndexes(ctx context.Context) error
+	List(ctx context.Context) ([]Product, error)
+	Get(ctx context.Context, productID string) (*Product, error)
+	Insert(ctx context.Context, product *Product) error
+	// Update overwrites the editable fields of product and reloads it
+	Update(ctx context.Context, product *Product) error
+	Delete(ctx context.Context, productID string) error
+	// ReserveStock moves quantities from available to reserved stock and
+	// fails with *InsufficientStockError without reserving anything if any
+	// line can't be met. The Mongo implementation relies on running inside
+	// a Transactor for the all-or-nothing part.
+	ReserveStock(ctx context.Context, items []CartItem) error
+	// ReleaseStock returns reserved quantities to available stock
+	ReleaseStock(ctx context.Context, items []CartItem) error
+	// CommitStock consumes reserved quantities once they are paid for
+	CommitStock(ctx context.Context, items []CartItem) error
+	// Restock adds quantities back to available stock
+	Restock(ctx context.Context, items []CartItem) error
+	// BackfillStock gives products stored before stock was tracked stock
+	// units and none reserved, and returns how many there were
+	BackfillStock(ctx context.Context, stock int) (int64, error)
+}
+
+// CartRepository stores one cart per user
+type CartRepository interface {
+	// Get returns the user's cart, or an empty cart if they have none
+	Get(ctx context.Context, userID string) (*Cart, error)
+	// AddItem merges item into the existing line for its product, or adds
+	// a new line if there is none. It reports whether the cart had to be
+	// created.
+	AddItem(ctx context.Context, userID string, item CartItem) (bool, error)
+	// SetItemQuantity and RemoveItem return ErrNotFound if the cart has no
+	// line for productID
+	SetItemQuantity(ctx context.Context, userID, productID string, quantity int) error
+	RemoveItem(ctx context.Context, userID, productID string) error
+	Clear(ctx context.Context, userID string) error
+}
+
+// TransactionRepository stores transactions. Methods that take an expected
+// state only apply the change if the stored transaction still matches it,
+// and report whether they did.
+type TransactionRepository interface {
+	Insert(ctx context.Context, transaction *Transaction) error
+	Get(ctx context.Context, transactionID primitive.ObjectID) (*Transaction, error)
+	// FindPending returns a pending transaction of the user that has not
+	// expired as of now
+	FindPending(ctx context.Context, userID string, now time.Time) (*Transaction, error)
+	// ListByUser returns the user's transactions, leaving out voided ones
+	ListByUser(ctx context.Context, userID string) ([]Transaction, error)
+	// ListExpired returns pending transactions whose expiry is at or before
+	// now, and awaiting-payment ones whose expiry is awaitingPaymentGrace
+	// before now
+	ListExpired(ctx context.Context, now time.Time) ([]Transaction, error)
+	UpdateStatus(ctx context.Context, transactionID primitive.ObjectID, from TransactionStatus, change StatusChange) (bool, error)
+	// ReplaceStatus moves every transaction in status from to change.To
+	ReplaceStatus(ctx context.Context, from TransactionStatus, change StatusChange) (int64, error)
+	SetPayment(ctx context.Context, transactionID primitive.ObjectID, paymentID string, method payment.MaskedCard) error
+	AddRefund(ctx context.Context, transactionID primitive.ObjectID, status TransactionStatus, existingRefunds int, refund Refund) (bool, error)
+	RemoveRefund(ctx context.Context, transactionID primitive.ObjectID, refundID primitive.ObjectID) error
+	MarkVoided(ctx context.Context, transactionID primitive.ObjectID, at time.Time, by string) error
+	Delete(ctx context.Context, transactionID primitive.ObjectID) error
+}
+
+// AuditLog stores the audit trail of operations on transactions
+type AuditLog interface {
+	Record(ctx context.Context, entry AuditEntry) error
+}
+
+// Transactor runs a function atomically across repositories. The ctx passed
+// to fn must be handed to every repository call that should take part.
+type Transactor interface {
+	WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error
+}
+
+// Repositories bundles the storage used by the handlers
+type Repositories struct {
+	Users           UserRepository
+	Products        ProductRepository
+	Carts           CartRepository
+	Transactions    TransactionRepository
+	Audit           AuditLog
+	PasswordResets  PasswordResetRepository
+	RefreshTokens   RefreshTokenRepository
+	RevokedTokens   RevokedTokenRepository
+	IdempotencyKeys IdempotencyKeyRepository
+	Transactor      Transactor
+}
+
+var (
+	users           UserRepository
+	products        ProductRepository
+	carts           CartRepository
+	transactions    TransactionRepository
+	auditLog        AuditLog
+	passwordResets  PasswordResetRepository
+	refreshTokens   RefreshTokenRepository
+	revokedTokens   RevokedTokenRepository
+	idempotencyKeys IdempotencyKeyRepository
+	transactor      Transactor
+)
+
+// SetRepositories sets the storage used by the handlers
+func SetRepositories(repositories Repositories) {
+	users = repositories.Users
+	products = repositories.Products
+	carts = repositories.Carts
+	transactions = repositories.Transactions
+	auditLog = repositories.Audit
+	passwordResets = repositories.PasswordResets
+	refreshTokens = repositories.RefreshTokens
+	revokedTokens = repositories.RevokedTokens
+	idempotencyKeys = repositories.IdempotencyKeys
+	revocations.reset()
+	sessionUsers.reset()
+	transactor = repositories.Transactor
+}
@@ -0,0 +1,52 @@
+package microServerMainFiles
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log/slog"
+)
+
+// MongoRevokedTokenRepository stores revoked access token IDs in the
+// revoked_tokens collection
+type MongoRevokedTokenRepository struct {
+	collection *mongo.Collection
+}
+
+// NewMongoRevokedTokenRepository returns a RevokedTokenRepository backed by
+// the revoked_tokens collection of database
+func NewMongoRevokedTokenRepository(database *mongo.Database) *MongoRevokedTokenRepository {
+	return &MongoRevokedTokenRepository{collection: database.Collection("revoked_tokens")}
+}
+
+// InitRevokedTokens creates the index that has MongoDB remove revoked
+// token IDs once the tokens have expired
+func InitRevokedTokens() error {
+	err := revokedTokens.EnsureIndexes(context.TODO())
+	if err != nil {
+		slog.Error("Error creating revoked token index", "err", err)
+	}
+	return err
+}
+
+func (r *MongoRevokedTokenRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	return err
+}
+
+func (r *MongoRevokedTokenRepository) Revoke(ctx context.Context, token RevokedToken) error {
+	_, err := r.collection.ReplaceOne(ctx, bson.M{"_id": token.ID}, token, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (r *MongoRevokedTokenRepository) IsRevoked(ctx context.Context, tokenID string) (bool, error) {
+	err := r.collection.FindOne(ctx, bson.M{"_id": tokenID}).Err()
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	}
+	return err == nil, err
+}
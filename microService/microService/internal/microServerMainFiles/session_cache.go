@@ -0,0 +1,94 @@
+package microServerMainFiles
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// sessionUserCacheTTL is how long what the user store said about a user is
+// used by JWTMiddleware before it is asked again. Changes made by this
+// process are seen at once; those made by another instance within this
+// long.
+const sessionUserCacheTTL = 30 * time.Second
+
+// sessionUser is what JWTMiddleware needs to know about the user a token
+// was issued to
+type sessionUser struct {
+	exists             bool
+	emailVerified      bool
+	sessionsValidAfter time.Time
+}
+
+// sessionUserCache remembers users looked up by JWTMiddleware, so the user
+// store isn't asked on every request
+type sessionUserCache struct {
+	mu      sync.Mutex
+	entries map[string]sessionUserEntry
+}
+
+type sessionUserEntry struct {
+	user  sessionUser
+	until time.Time
+}
+
+var sessionUsers = &sessionUserCache{entries: make(map[string]sessionUserEntry)}
+
+func (c *sessionUserCache) get(email string, now time.Time) (sessionUser, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[email]
+	if !ok || !now.Before(entry.until) {
+		return sessionUser{}, false
+	}
+	return entry.user, true
+}
+
+func (c *sessionUserCache) set(email string, user sessionUser, until time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[email] = sessionUserEntry{user: user, until: until}
+	// Sweep now and then so users who stop calling don't pile up
+	if len(c.entries)%1024 == 0 {
+		now := time.Now()
+		for email, entry := range c.entries {
+			if !now.Before(entry.until) {
+				delete(c.entries, email)
+			}
+		}
+	}
+}
+
+// forget drops the user with email, for when this process changes them
+func (c *sessionUserCache) forget(email string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, email)
+}
+
+// reset forgets everything, for when the store behind the cache changes
+func (c *sessionUserCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]sessionUserEntry)
+}
+
+// lookupSessionUser returns what the user store says about the user with
+// email, from the cache if it was asked recently
+func lookupSessionUser(ctx context.Context, email string) (sessionUser, error) {
+	now := time.Now()
+	if user, ok := sessionUsers.get(email, now); ok {
+		return user, nil
+	}
+	credentials, err := users.GetByEmail(ctx, email)
+	if err != nil && err != ErrNotFound {
+		return sessionUser{}, err
+	}
+	user := sessionUser{
+		exists:             err == nil,
+		emailVerified:      credentials.EmailVerified,
+		sessionsValidAfter: credentials.SessionsValidAfter,
+	}
+	sessionUsers.set(email, user, now.Add(sessionUserCacheTTL))
+	return user, nil
+}
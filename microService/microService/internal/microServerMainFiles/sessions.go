@@ -0,0 +1,85 @@
+package microServerMainFiles
+
+import (
+	"context"
+	"time"
+)
+
+// Session is a login as shown to its user: a refresh token family and the
+// client it was last renewed from
+type Session struct {
+	ID         string    `json:"id"`
+	Device     string    `json:"device"`
+	IP         string    `json:"ip"`
+	StartedAt  time.Time `json:"started_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	// Current marks the session of the token the list was asked for with
+	Current bool `json:"current"`
+}
+
+var errSessionNotFound = NotFound("session_not_found", "Session not found")
+
+// ListSessions returns the active sessions of the user with email, newest
+// first. currentID is the session the caller is using.
+func ListSessions(ctx context.Context, email, currentID string) ([]Session, error) {
+	tokens, err := refreshTokens.ListActive(ctx, email, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	sessions := make([]Session, len(tokens))
+	for i, token := range tokens {
+		sessions[i] = Session{
+			ID:         token.Family,
+			Device:     token.UserAgent,
+			IP:         token.IP,
+			StartedAt:  token.SessionStart,
+			LastUsedAt: token.CreatedAt,
+			ExpiresAt:  token.ExpiresAt,
+			Current:    token.Family == currentID,
+		}
+	}
+	return sessions, nil
+}
+
+// EndUserSession revokes the session with id, which must be an active
+// session of the user with email. Other users' sessions are reported as
+// not found so their IDs can't be probed.
+func EndUserSession(ctx context.Context, email, id string) error {
+	tokens, err := refreshTokens.ListFamily(ctx, id)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	active := false
+	for _, token := range tokens {
+		if token.Email != email {
+			return errSessionNotFound
+		}
+		if token.RevokedAt.IsZero() && token.ExpiresAt.After(now) {
+			active = true
+		}
+	}
+	if !active {
+		return errSessionNotFound
+	}
+	return revokeSession(ctx, id)
+}
+
+// EndOtherSessions revokes every session of the user with email except
+// keepID, e.g. after they change their password
+func EndOtherSessions(ctx context.Context, email, keepID string) error {
+	tokens, err := refreshTokens.ListActive(ctx, email, time.Now())
+	if err != nil {
+		return err
+	}
+	for _, token := range tokens {
+		if token.Family == keepID {
+			continue
+		}
+		if err := revokeSession(ctx, token.Family); err != nil {
+			return err
+		}
+	}
+	return nil
+}
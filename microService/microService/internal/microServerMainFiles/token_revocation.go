@@ -0,0 +1,97 @@
+package microServerMainFiles
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// revocationCacheTTL is how long a token found not to be revoked is taken
+// at its word before the store is asked again. Revocations made by this
+// process are seen at once; those made by another instance within this
+// long.
+const revocationCacheTTL = 30 * time.Second
+
+// RevokedToken is the ID of a revoked access token, kept until the token
+// would have expired anyway
+type RevokedToken struct {
+	ID        string    `bson:"_id"`
+	ExpiresAt time.Time `bson:"expires_at"`
+}
+
+// revocationCache remembers what the revoked token store said about token
+// IDs, so JWTMiddleware doesn't ask it on every request. A revoked token is
+// remembered until it expires, a valid one for revocationCacheTTL.
+type revocationCache struct {
+	mu      sync.Mutex
+	entries map[string]revocationEntry
+}
+
+type revocationEntry struct {
+	revoked bool
+	until   time.Time
+}
+
+var revocations = &revocationCache{entries: make(map[string]revocationEntry)}
+
+func (c *revocationCache) get(tokenID string, now time.Time) (revoked, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[tokenID]
+	if !ok || !now.Before(entry.until) {
+		return false, false
+	}
+	return entry.revoked, true
+}
+
+func (c *revocationCache) set(tokenID string, revoked bool, until time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[tokenID] = revocationEntry{revoked: revoked, until: until}
+	// Sweep now and then so tokens that are never seen again don't pile up
+	if len(c.entries)%1024 == 0 {
+		now := time.Now()
+		for id, entry := range c.entries {
+			if !now.Before(entry.until) {
+				delete(c.entries, id)
+			}
+		}
+	}
+}
+
+// reset forgets everything, for when the store behind the cache changes
+func (c *revocationCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]revocationEntry)
+}
+
+// isTokenRevoked reports whether the access token with ID tokenID has been
+// revoked
+func isTokenRevoked(ctx context.Context, tokenID string) (bool, error) {
+	now := time.Now()
+	if revoked, ok := revocations.get(tokenID, now); ok {
+		return revoked, nil
+	}
+	revoked, err := revokedTokens.IsRevoked(ctx, tokenID)
+	if err != nil {
+		return false, err
+	}
+	until := now.Add(revocationCacheTTL)
+	if revoked {
+		// Revoked tokens stay revoked; no token outlives jwtTTL
+		until = now.Add(jwtTTL)
+	}
+	revocations.set(tokenID, revoked, until)
+	return revoked, nil
+}
+
+// revokeAccessToken revokes the access token with ID tokenID, which expires
+// at expiresAt
+func revokeAccessToken(ctx context.Context, tokenID string, expiresAt time.Time) error {
+	if err := revokedTokens.Revoke(ctx, RevokedToken{ID: tokenID, ExpiresAt: expiresAt}); err != nil {
+		return err
+	}
+	revocations.set(tokenID, true, expiresAt)
+	return nil
+}
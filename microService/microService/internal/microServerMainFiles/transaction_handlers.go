@@ -0,0 +1,263 @@
+package microServerMainFiles
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+var (
+	errTransactionNotFound  = NotFound("transaction_not_found", "Transaction not found")
+	errInvalidTransactionID = Validation("invalid_transaction_id", "Invalid transaction ID")
+)
+
+// TransactionAction handles /api/transactions/{id}/{action}
+func TransactionAction(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/transactions/"), "/")
+	if len(parts) != 2 || parts[0] == "" {
+		writeProblem(w, r, http.StatusNotFound, "not_found", "Not found")
+		return
+	}
+
+	transactionID, err := primitive.ObjectIDFromHex(parts[0])
+	if err != nil {
+		writeError(w, r, errInvalidTransactionID)
+		return
+	}
+
+	switch parts[1] {
+	case "status":
+		SetTransactionStatus(w, r, transactionID)
+	case "refund":
+		RefundTransactionHandler(w, r, transactionID)
+	case "cancel":
+		CancelTransactionHandler(w, r, transactionID)
+	case "void":
+		VoidTransactionHandler(w, r, transactionID)
+	default:
+		writeProblem(w, r, http.StatusNotFound, "not_found", "Not found")
+	}
+}
+
+// SetTransactionStatus lets an admin move a transaction to a new status:
+// fulfilled for a paid order, cancelled for a pending one (releasing its
+// stock) or refunded (refunding everything not yet refunded). Other
+// statuses are only reached through checkout, payment and expiry, which
+// also move the stock and money, so asking for them is a conflict.
+func SetTransactionStatus(w http.ResponseWriter, r *http.Request, transactionID primitive.ObjectID) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, r)
+		return
+	}
+	if !isAdmin(r) {
+		writeError(w, r, errAdminRequired)
+		return
+	}
+
+	var request struct {
+		Status TransactionStatus `json:"status"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, r, errInvalidBody)
+		return
+	}
+	if !request.Status.IsValid() {
+		writeError(w, r, Validation("unknown_status", "Unknown status", FieldError{Field: "status", Message: "is not a known status"}))
+		return
+	}
+
+	transaction, actor, ok := loadOwnedTransaction(w, r, transactionID)
+	if !ok {
+		return
+	}
+
+	ctx := detachedContext(r)
+	var err error
+	switch request.Status {
+	case StatusFulfilled:
+		if transaction.Status != StatusPaid {
+			err = &IllegalTransitionError{From: transaction.Status, To: StatusFulfilled}
+			break
+		}
+		transaction, err = UpdateTransactionStatus(ctx, transactionID, StatusFulfilled, actor)
+	case StatusCancelled:
+		transaction, err = CancelTransaction(ctx, transaction, actor)
+	case StatusRefunded:
+		if _, err = RefundTransaction(ctx, transaction, nil, actor); err == nil {
+			transaction, err = RetrieveTransaction(ctx, transactionID)
+		}
+	default:
+		err = Conflict("status_not_settable", "Transactions can't be set to "+string(request.Status)+" directly")
+	}
+	if err != nil {
+		writePaymentError(w, r, err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Transaction status changed", "transaction_id", transactionID.Hex(), "status", request.Status)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(transaction)
+}
+
+// RefundTransactionHandler refunds a paid transaction. The optional body
+// {"items": [{"product_id": "1", "quantity": 1}]} refunds just those units;
+// without it everything not yet refunded is refunded. Admin only.
+func RefundTransactionHandler(w http.ResponseWriter, r *http.Request, transactionID primitive.ObjectID) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, r)
+		return
+	}
+	if !isAdmin(r) {
+		writeError(w, r, errAdminRequired)
+		return
+	}
+
+	transaction, actor, ok := loadOwnedTransaction(w, r, transactionID)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		Items []RefundLine `json:"items"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil && err != io.EOF {
+			writeError(w, r, errInvalidBody)
+			return
+		}
+	}
+
+	refund, err := RefundTransaction(detachedContext(r), transaction, request.Items, actor)
+	if err != nil {
+		writePaymentError(w, r, err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Transaction refunded", "transaction_id", transactionID.Hex(), "amount", refund.Amount)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(refund)
+}
+
+// CancelTransactionHandler cancels a pending transaction
+func CancelTransactionHandler(w http.ResponseWriter, r *http.Request, transactionID primitive.ObjectID) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, r)
+		return
+	}
+
+	transaction, actor, ok := loadOwnedTransaction(w, r, transactionID)
+	if !ok {
+		return
+	}
+
+	cancelled, err := CancelTransaction(detachedContext(r), transaction, actor)
+	if err != nil {
+		writeTransitionError(w, r, err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Transaction cancelled", "transaction_id", transactionID.Hex())
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cancelled)
+}
+
+// VoidTransactionHandler voids a pending transaction, keeping it on record
+func VoidTransactionHandler(w http.ResponseWriter, r *http.Request, transactionID primitive.ObjectID) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, r)
+		return
+	}
+
+	transaction, actor, ok := loadOwnedTransaction(w, r, transactionID)
+	if !ok {
+		return
+	}
+
+	voided, err := VoidTransaction(detachedContext(r), transaction, actor)
+	if err != nil {
+		writeTransitionError(w, r, err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Transaction voided", "transaction_id", transactionID.Hex())
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(voided)
+}
+
+// PurgeTransactionHandler handles DELETE /api/admin/transactions/{id}, which
+// permanently removes a transaction. Admin only; meant for test data.
+func PurgeTransactionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeMethodNotAllowed(w, r)
+		return
+	}
+	if !isAdmin(r) {
+		writeError(w, r, errAdminRequired)
+		return
+	}
+
+	transactionID, err := primitive.ObjectIDFromHex(strings.TrimPrefix(r.URL.Path, "/api/admin/transactions/"))
+	if err != nil {
+		writeError(w, r, errInvalidTransactionID)
+		return
+	}
+
+	transaction, actor, ok := loadOwnedTransaction(w, r, transactionID)
+	if !ok {
+		return
+	}
+
+	if err := PurgeTransaction(detachedContext(r), transaction, actor); err != nil {
+		writeTransitionError(w, r, err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Transaction purged", "transaction_id", transactionID.Hex())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// loadOwnedTransaction loads a transaction that belongs to the caller, or
+// any transaction for an admin. Other users' transactions are reported as
+// not found so their IDs can't be probed.
+func loadOwnedTransaction(w http.ResponseWriter, r *http.Request, transactionID primitive.ObjectID) (*Transaction, string, bool) {
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		slog.WarnContext(r.Context(), "User ID not found in context")
+		writeError(w, r, errNoUser)
+		return nil, "", false
+	}
+
+	transaction, err := RetrieveTransaction(r.Context(), transactionID)
+	if err == ErrNotFound || (err == nil && transaction.UserID != userID && !isAdmin(r)) {
+		writeError(w, r, errTransactionNotFound)
+		return nil, "", false
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error finding transaction", "transaction_id", transactionID.Hex(), "err", err)
+		writeError(w, r, err)
+		return nil, "", false
+	}
+	return transaction, userID, true
+}
+
+// detachedContext returns r's context without its cancellation, for
+// operations made of several writes, or a gateway call and writes, that must
+// not stop halfway because the client went away
+func detachedContext(r *http.Request) context.Context {
+	return context.WithoutCancel(r.Context())
+}
+
+// writeTransitionError answers a failed change to a stored transaction,
+// reporting a missing one as transaction_not_found
+func writeTransitionError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, ErrNotFound) {
+		writeError(w, r, errTransactionNotFound)
+		return
+	}
+	writeError(w, r, err)
+}
@@ -0,0 +1,150 @@
+package microServerMainFiles
+
+import (
+	"context"
+	"errors"
+	"microService/pkg/payment"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// signUpAdmin stores a verified admin, as admins are only made in the
+// database, and logs them in
+func signUpAdmin(t *testing.T, server *httptest.Server, address string) *testClient {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(testPassword), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("bcrypt.GenerateFromPassword() error = %v", err)
+	}
+	admin := UserCredentials{Email: address, Password: string(hash), Role: RoleAdmin, EmailVerified: true}
+	if err := users.Save(context.Background(), admin); err != nil {
+		t.Fatalf("users.Save() error = %v", err)
+	}
+
+	c := &testClient{t: t, server: server}
+	var pair TokenPair
+	c.expect(c.do(http.MethodPost, "/login", map[string]string{"email": address, "password": testPassword}, nil), http.StatusOK, &pair)
+	c.token = pair.AccessToken
+	return c
+}
+
+// checkOut puts two of product 1 in the buyer's cart and checks it out,
+// paying for it if pay is set
+func checkOut(buyer *testClient, pay bool) Transaction {
+	buyer.t.Helper()
+	var transaction Transaction
+	buyer.expect(buyer.do(http.MethodPost, "/api/cart/add", CartItem{ProductID: "1", Quantity: 2}, nil), http.StatusOK, nil)
+	buyer.expect(buyer.do(http.MethodPost, "/api/transaction/checkout", nil, nil), http.StatusOK, &transaction)
+	if pay {
+		var paid paymentResponse
+		buyer.expect(buyer.do(http.MethodPost, "/api/transaction/pay", approvedCard, nil), http.StatusOK, &paid)
+		transaction = paid.Transaction
+	}
+	return transaction
+}
+
+func setStatus(admin *testClient, transaction Transaction, status TransactionStatus) *http.Response {
+	admin.t.Helper()
+	return admin.do(http.MethodPost, "/api/transactions/"+transaction.ID.Hex()+"/status", map[string]TransactionStatus{"status": status}, nil)
+}
+
+func TestSetTransactionStatusFulfilled(t *testing.T) {
+	server := newTestServer(t)
+	buyer := signUp(t, server, "fulfil@example.com", true)
+	admin := signUpAdmin(t, server, "admin@example.com")
+	stock, _ := productStock(t, "1")
+	transaction := checkOut(buyer, true)
+
+	var fulfilled Transaction
+	admin.expect(setStatus(admin, transaction, StatusFulfilled), http.StatusOK, &fulfilled)
+	if fulfilled.Status != StatusFulfilled {
+		t.Fatalf("status = %s, want fulfilled", fulfilled.Status)
+	}
+	if available, reserved := productStock(t, "1"); available != stock-2 || reserved != 0 {
+		t.Errorf("stock = %d available, %d reserved; want %d, 0", available, reserved, stock-2)
+	}
+
+	// Only paid orders are fulfilled
+	admin.expectProblem(setStatus(admin, fulfilled, StatusFulfilled), http.StatusConflict, "illegal_transition")
+}
+
+func TestSetTransactionStatusCancelled(t *testing.T) {
+	server := newTestServer(t)
+	buyer := signUp(t, server, "cancel@example.com", true)
+	admin := signUpAdmin(t, server, "admin@example.com")
+	stock, _ := productStock(t, "1")
+	transaction := checkOut(buyer, false)
+
+	var cancelled Transaction
+	admin.expect(setStatus(admin, transaction, StatusCancelled), http.StatusOK, &cancelled)
+	if cancelled.Status != StatusCancelled {
+		t.Fatalf("status = %s, want cancelled", cancelled.Status)
+	}
+	if available, reserved := productStock(t, "1"); available != stock || reserved != 0 {
+		t.Errorf("stock = %d available, %d reserved; want the reservation released: %d, 0", available, reserved, stock)
+	}
+}
+
+func TestSetTransactionStatusRefunded(t *testing.T) {
+	server := newTestServer(t)
+	gateway := payment.NewSimulator()
+	buyer := signUp(t, server, "refund@example.com", true)
+	admin := signUpAdmin(t, server, "admin@example.com")
+	SetPaymentGateway(gateway)
+	stock, _ := productStock(t, "1")
+	transaction := checkOut(buyer, true)
+
+	var refunded Transaction
+	admin.expect(setStatus(admin, transaction, StatusRefunded), http.StatusOK, &refunded)
+	if refunded.Status != StatusRefunded {
+		t.Fatalf("status = %s, want refunded", refunded.Status)
+	}
+	if len(refunded.Refunds) != 1 || refunded.Refunds[0].Amount != transaction.TotalAmount {
+		t.Fatalf("refunds = %+v, want one of %.2f", refunded.Refunds, transaction.TotalAmount)
+	}
+	// The whole capture went back to the card, so nothing more can
+	if err := gateway.Refund(context.Background(), refunded.PaymentID, 0.01); !errors.Is(err, payment.ErrRefundExceedsCaptured) {
+		t.Errorf("refunding again at the gateway: error = %v, want ErrRefundExceedsCaptured", err)
+	}
+	if available, reserved := productStock(t, "1"); available != stock || reserved != 0 {
+		t.Errorf("stock = %d available, %d reserved; want the items restocked: %d, 0", available, reserved, stock)
+	}
+}
+
+func TestSetTransactionStatusRejected(t *testing.T) {
+	server := newTestServer(t)
+	buyer := signUp(t, server, "rejected@example.com", true)
+	admin := signUpAdmin(t, server, "admin@example.com")
+	stock, _ := productStock(t, "1")
+	transaction := checkOut(buyer, false)
+
+	tests := []struct {
+		status TransactionStatus
+		code   string
+	}{
+		{StatusPending, "status_not_settable"},
+		{StatusAwaitingPayment, "status_not_settable"},
+		{StatusPaid, "status_not_settable"},
+		{StatusExpired, "status_not_settable"},
+		{StatusFulfilled, "illegal_transition"},
+		{StatusRefunded, "illegal_transition"},
+	}
+	for _, tt := range tests {
+		admin.expectProblem(setStatus(admin, transaction, tt.status), http.StatusConflict, tt.code)
+	}
+
+	var pending Transaction
+	buyer.expect(buyer.do(http.MethodGet, "/api/transaction/pending", nil, nil), http.StatusOK, &pending)
+	if pending.ID != transaction.ID || len(pending.StatusHistory) != len(transaction.StatusHistory) {
+		t.Errorf("transaction changed: %+v", pending)
+	}
+	if available, reserved := productStock(t, "1"); available != stock-2 || reserved != 2 {
+		t.Errorf("stock = %d available, %d reserved; want the reservation kept: %d, 2", available, reserved, stock-2)
+	}
+
+	// Customers can't set statuses at all
+	buyer.expectProblem(setStatus(buyer, transaction, StatusCancelled), http.StatusForbidden, "admin_required")
+}
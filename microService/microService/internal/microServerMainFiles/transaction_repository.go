@@ -0,0 +1,158 @@
+package microServerMainFiles
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"microService/pkg/payment"
+	"time"
+)
+
+// MongoTransactionRepository stores transactions in the transactions
+// collection
+type MongoTransactionRepository struct {
+	collection *mongo.Collection
+}
+
+// NewMongoTransactionRepository returns a TransactionRepository backed by
+// the transactions collection of database
+func NewMongoTransactionRepository(database *mongo.Database) *MongoTransactionRepository {
+	return &MongoTransactionRepository{collection: database.Collection("transactions")}
+}
+
+func (r *MongoTransactionRepository) Insert(ctx context.Context, transaction *Transaction) error {
+	result, err := r.collection.InsertOne(ctx, transaction)
+	if err != nil {
+		return err
+	}
+	transaction.ID = result.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+func (r *MongoTransactionRepository) Get(ctx context.Context, transactionID primitive.ObjectID) (*Transaction, error) {
+	return r.findOne(ctx, bson.M{"_id": transactionID})
+}
+
+func (r *MongoTransactionRepository) FindPending(ctx context.Context, userID string, now time.Time) (*Transaction, error) {
+	return r.findOne(ctx, bson.M{
+		"user_id": userID,
+		"status":  StatusPending,
+		// Transactions created before expiry was tracked never expire
+		"$or": bson.A{
+			bson.M{"expires_at": bson.M{"$exists": false}},
+			bson.M{"expires_at": bson.M{"$gt": now}},
+		},
+	})
+}
+
+func (r *MongoTransactionRepository) ListByUser(ctx context.Context, userID string) ([]Transaction, error) {
+	return r.find(ctx, bson.M{"user_id": userID, "voided_at": bson.M{"$exists": false}})
+}
+
+func (r *MongoTransactionRepository) ListExpired(ctx context.Context, now time.Time) ([]Transaction, error) {
+	return r.find(ctx, bson.M{"$or": bson.A{
+		bson.M{"status": StatusPending, "expires_at": bson.M{"$lte": now}},
+		bson.M{"status": StatusAwaitingPayment, "expires_at": bson.M{"$lte": now.Add(-awaitingPaymentGrace)}},
+	}})
+}
+
+func (r *MongoTransactionRepository) UpdateStatus(ctx context.Context, transactionID primitive.ObjectID, from TransactionStatus, change StatusChange) (bool, error) {
+	result, err := r.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": transactionID, "status": from},
+		bson.M{
+			"$set":  bson.M{"status": change.To},
+			"$push": bson.M{"status_history": change},
+		},
+	)
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount > 0, nil
+}
+
+func (r *MongoTransactionRepository) ReplaceStatus(ctx context.Context, from TransactionStatus, change StatusChange) (int64, error) {
+	result, err := r.collection.UpdateMany(
+		ctx,
+		bson.M{"status": from},
+		bson.M{
+			"$set":  bson.M{"status": change.To},
+			"$push": bson.M{"status_history": change},
+		},
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
+
+func (r *MongoTransactionRepository) SetPayment(ctx context.Context, transactionID primitive.ObjectID, paymentID string, method payment.MaskedCard) error {
+	return r.updateByID(ctx, transactionID, bson.M{"$set": bson.M{"payment_id": paymentID, "payment_method": method}})
+}
+
+func (r *MongoTransactionRepository) AddRefund(ctx context.Context, transactionID primitive.ObjectID, status TransactionStatus, existingRefunds int, refund Refund) (bool, error) {
+	result, err := r.collection.UpdateOne(
+		ctx,
+		bson.M{
+			"_id":    transactionID,
+			"status": status,
+			"$expr":  bson.M{"$eq": bson.A{bson.M{"$size": bson.M{"$ifNull": bson.A{"$refunds", bson.A{}}}}, existingRefunds}},
+		},
+		bson.M{"$push": bson.M{"refunds": refund}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount > 0, nil
+}
+
+func (r *MongoTransactionRepository) RemoveRefund(ctx context.Context, transactionID primitive.ObjectID, refundID primitive.ObjectID) error {
+	return r.updateByID(ctx, transactionID, bson.M{"$pull": bson.M{"refunds": bson.M{"id": refundID}}})
+}
+
+func (r *MongoTransactionRepository) MarkVoided(ctx context.Context, transactionID primitive.ObjectID, at time.Time, by string) error {
+	return r.updateByID(ctx, transactionID, bson.M{"$set": bson.M{"voided_at": at, "voided_by": by}})
+}
+
+func (r *MongoTransactionRepository) Delete(ctx context.Context, transactionID primitive.ObjectID) error {
+	result, err := r.collection.DeleteOne(ctx, bson.M{"_id": transactionID})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *MongoTransactionRepository) findOne(ctx context.Context, filter bson.M) (*Transaction, error) {
+	var transaction Transaction
+	if err := r.collection.FindOne(ctx, filter).Decode(&transaction); err != nil {
+		return nil, err
+	}
+	return &transaction, nil
+}
+
+func (r *MongoTransactionRepository) find(ctx context.Context, filter bson.M) ([]Transaction, error) {
+	var transactions []Transaction
+	cursor, err := r.collection.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	if err = cursor.All(ctx, &transactions); err != nil {
+		return nil, err
+	}
+	return transactions, nil
+}
+
+func (r *MongoTransactionRepository) updateByID(ctx context.Context, transactionID primitive.ObjectID, update bson.M) error {
+	result, err := r.collection.UpdateOne(ctx, bson.M{"_id": transactionID}, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package microServerMainFiles
+
+import (
+	"context"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"log/slog"
+	"time"
+)
+
+// TransactionStatus is the lifecycle state of a Transaction
+type TransactionStatus string
+
+const (
+	StatusPending         TransactionStatus = "pending"
+	StatusAwaitingPayment TransactionStatus = "awaiting_payment"
+	StatusPaid            TransactionStatus = "paid"
+	StatusFulfilled       TransactionStatus = "fulfilled"
+	StatusCancelled       TransactionStatus = "cancelled"
+	StatusRefunded        TransactionStatus = "refunded"
+	StatusExpired         TransactionStatus = "expired"
+)
+
+// legacyStatusCompleted is what ProcessPayment used to store for paid
+// transactions; InitTransactionStatuses rewrites it to StatusPaid
+const legacyStatusCompleted TransactionStatus = "completed"
+
+// SystemActor is recorded in the status history for transitions that no
+// user asked for, such as expiry
+const SystemActor = "system"
+
+// transactionTransitions lists, for each status, the statuses it may move
+// to. Statuses without an entry are terminal.
+var transactionTransitions = map[TransactionStatus][]TransactionStatus{
+	StatusPending:         {StatusAwaitingPayment, StatusCancelled, StatusExpired},
+	StatusAwaitingPayment: {StatusPaid, StatusPending, StatusCancelled, StatusExpired},
+	StatusPaid:            {StatusFulfilled, StatusRefunded},
+	StatusFulfilled:       {StatusRefunded},
+}
+
+// StatusChange is one entry in a transaction's status history
+type StatusChange struct {
+	From  TransactionStatus `bson:"from,omitempty" json:"from,omitempty"`
+	To    TransactionStatus `bson:"to" json:"to"`
+	At    time.Time         `bson:"at" json:"at"`
+	Actor string            `bson:"actor" json:"actor"`
+}
+
+// IllegalTransitionError is returned when a transaction is asked to move to
+// a status its current status does not allow
+type IllegalTransitionError struct {
+	From TransactionStatus
+	To   TransactionStatus
+}
+
+func (e *IllegalTransitionError) Error() string {
+	return fmt.Sprintf("illegal transaction status transition from %q to %q", e.From, e.To)
+}
+
+// IsValid reports whether s is one of the known statuses
+func (s TransactionStatus) IsValid() bool {
+	switch s {
+	case StatusPending, StatusAwaitingPayment, StatusPaid, StatusFulfilled,
+		StatusCancelled, StatusRefunded, StatusExpired:
+		return true
+	}
+	return false
+}
+
+// CanTransition reports whether a transaction in status from may move to to
+func CanTransition(from, to TransactionStatus) bool {
+	for _, next := range transactionTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// UpdateTransactionStatus moves a transaction to status, recording the
+// change and actor in its status history. This is the only place a
+// transaction's status changes after creation. The write only applies if
+// the status is still the one that was checked, so two callers racing on
+// the same transaction can't both succeed. It returns ErrNotFound if the
+// transaction does not exist and *IllegalTransitionError if its current
+// status does not allow the move.
+func UpdateTransactionStatus(ctx context.Context, transactionID primitive.ObjectID, status TransactionStatus, actor string) (*Transaction, error) {
+	current, err := transactions.Get(ctx, transactionID)
+	if err != nil {
+		if err != ErrNotFound {
+			slog.ErrorContext(ctx, "Error finding transaction", "transaction_id", transactionID.Hex(), "err", err)
+		}
+		return nil, err
+	}
+	if !CanTransition(current.Status, status) {
+		return nil, &IllegalTransitionError{From: current.Status, To: status}
+	}
+
+	change := StatusChange{From: current.Status, To: status, At: time.Now(), Actor: actor}
+	updated, err := transactions.UpdateStatus(ctx, transactionID, current.Status, change)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error updating transaction status in database", "transaction_id", transactionID.Hex(), "err", err)
+		return nil, err
+	}
+	if !updated {
+		// Someone else moved it first; report against whatever it is now
+		current, err := transactions.Get(ctx, transactionID)
+		if err != nil {
+			return nil, err
+		}
+		return nil, &IllegalTransitionError{From: current.Status, To: status}
+	}
+
+	current.Status = status
+	current.StatusHistory = append(current.StatusHistory, change)
+	return current, nil
+}
+
+// InitTransactionStatuses rewrites statuses stored before the state machine
+// existed so every transaction is in a known state
+func InitTransactionStatuses() error {
+	migrated, err := transactions.ReplaceStatus(context.TODO(), legacyStatusCompleted, StatusChange{
+		From: legacyStatusCompleted, To: StatusPaid, At: time.Now(), Actor: SystemActor,
+	})
+	if err != nil {
+		slog.Error("Error migrating transaction statuses", "err", err)
+		return err
+	}
+	if migrated > 0 {
+		slog.Info("Migrated completed transactions", "count", migrated, "status", StatusPaid)
+	}
+	return nil
+}
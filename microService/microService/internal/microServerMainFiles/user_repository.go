@@ -5,40 +5,140 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"log/slog"
 	"time"
 )
 
-var client *mongo.Client
-var usersCollection *mongo.Collection
+// userQueryTimeout bounds each query against the users collection
+const userQueryTimeout = 5 * time.Second
 
-func init() {
-	// Connect to MongoDB
-	var err error
-	client, err = mongo.NewClient(options.Client().ApplyURI("mongodb://localhost:27017"))
-	if err != nil {
-		panic(err)
+// MongoUserRepository stores user credentials in the users collection
+type MongoUserRepository struct {
+	collection *mongo.Collection
+}
+
+// NewMongoUserRepository returns a UserRepository backed by the users
+// collection of database
+func NewMongoUserRepository(database *mongo.Database) *MongoUserRepository {
+	return &MongoUserRepository{collection: database.Collection("users")}
+}
+
+// InitUsers creates the users indexes, including the unique one on email so
+// two accounts can't share an address, and marks accounts from before email
+// verification as verified: they were sent their password by email, so
+// logging in already proved they own the address.
+func InitUsers() error {
+	if err := users.EnsureIndexes(context.TODO()); err != nil {
+		slog.Error("Error creating users indexes; remove duplicate accounts first", "err", err)
+		return err
 	}
-	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
-	err = client.Connect(ctx)
+
+	verified, err := users.VerifyLegacyUsers(context.TODO())
 	if err != nil {
-		panic(err)
+		slog.Error("Error marking existing users verified", "err", err)
+		return err
+	}
+	if verified > 0 {
+		slog.Info("Marked existing users verified", "count", verified)
 	}
+	return nil
+}
+
+func (r *MongoUserRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "email", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "verification_token_hash", Value: 1}},
+			Options: options.Index().SetSparse(true),
+		},
+	})
+	return err
+}
 
-	// Get the users collection
-	usersCollection = client.Database("authDB").Collection("users")
+func (r *MongoUserRepository) VerifyLegacyUsers(ctx context.Context) (int64, error) {
+	result, err := r.collection.UpdateMany(ctx,
+		bson.M{"email_verified": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"email_verified": true}},
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
 }
 
-func SaveUser(user UserCredentials) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+func (r *MongoUserRepository) Save(ctx context.Context, user UserCredentials) error {
+	ctx, cancel := context.WithTimeout(ctx, userQueryTimeout)
 	defer cancel()
-	_, err := usersCollection.InsertOne(ctx, user)
+	_, err := r.collection.InsertOne(ctx, user)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicate
+	}
 	return err
 }
 
-func GetUserByEmail(email string) (UserCredentials, error) {
+func (r *MongoUserRepository) GetByEmail(ctx context.Context, email string) (UserCredentials, error) {
 	var user UserCredentials
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, userQueryTimeout)
 	defer cancel()
-	err := usersCollection.FindOne(ctx, bson.M{"email": email}).Decode(&user)
+	err := r.collection.FindOne(ctx, bson.M{"email": email}).Decode(&user)
 	return user, err
 }
+
+func (r *MongoUserRepository) UpdatePassword(ctx context.Context, email, passwordHash string) error {
+	ctx, cancel := context.WithTimeout(ctx, userQueryTimeout)
+	defer cancel()
+	result, err := r.collection.UpdateOne(ctx, bson.M{"email": email}, bson.M{"$set": bson.M{"password": passwordHash}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *MongoUserRepository) RevokeSessions(ctx context.Context, email string, at time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, userQueryTimeout)
+	defer cancel()
+	result, err := r.collection.UpdateOne(ctx, bson.M{"email": email}, bson.M{"$set": bson.M{"sessions_valid_after": at}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *MongoUserRepository) SetVerificationToken(ctx context.Context, email, tokenHash string, expiresAt time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, userQueryTimeout)
+	defer cancel()
+	result, err := r.collection.UpdateOne(ctx, bson.M{"email": email}, bson.M{"$set": bson.M{
+		"verification_token_hash": tokenHash,
+		"verification_expires_at": expiresAt,
+	}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *MongoUserRepository) VerifyEmail(ctx context.Context, tokenHash string, now time.Time) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, userQueryTimeout)
+	defer cancel()
+	var user UserCredentials
+	err := r.collection.FindOneAndUpdate(ctx,
+		bson.M{"verification_token_hash": tokenHash, "verification_expires_at": bson.M{"$gt": now}},
+		bson.M{
+			"$set":   bson.M{"email_verified": true},
+			"$unset": bson.M{"verification_token_hash": "", "verification_expires_at": ""},
+		},
+	).Decode(&user)
+	return user.Email, err
+}
@@ -1,39 +1,90 @@
 package email
 
 import (
+	"context"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
 	"gopkg.in/gomail.v2"
 	"io"
+	"net"
 	"net/smtp"
+	"strconv"
 )
 
-const (
-	SMTPServer   = "smtp.gmail.com"
-	SMTPPort     = "587"
-	AuthEmail    = "bdauren06@gmail.com"
-	AuthPassword = "lrhcvmwjvdkbjrkc"
-)
+// Config holds the SMTP server and account used to send mail
+type Config struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+var config Config
+
+// tracer creates the spans for sends that are traced
+var tracer = otel.Tracer("microService/pkg/email")
+
+// Configure sets the SMTP settings used by every send function
+func Configure(cfg Config) {
+	config = cfg
+}
+
+// Ping connects to the SMTP server and waits for its greeting, without
+// authenticating or sending anything
+func Ping(ctx context.Context) error {
+	addr := net.JoinHostPort(config.Host, strconv.Itoa(config.Port))
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	client, err := smtp.NewClient(conn, config.Host)
+	if err != nil {
+		return err
+	}
+	return client.Quit()
+}
 
 func SendEmail(to, subject, body string) error {
-	auth := smtp.PlainAuth("", AuthEmail, AuthPassword, SMTPServer)
+	auth := smtp.PlainAuth("", config.Username, config.Password, config.Host)
 	msg := []byte("To: " + to + "\r\n" +
 		"Subject: " + subject + "\r\n" +
 		"\r\n" +
 		body + "\r\n")
-	return smtp.SendMail(SMTPServer+":"+SMTPPort, auth, AuthEmail, []string{to}, msg)
+	return countSend(smtp.SendMail(config.Host+":"+strconv.Itoa(config.Port), auth, config.From, []string{to}, msg))
+}
+
+// SendReceiptEmail sends a receipt PDF, traced as a span under ctx
+func SendReceiptEmail(ctx context.Context, to, subject, body string, attachment []byte) error {
+	_, span := tracer.Start(ctx, "SendReceiptEmail")
+	defer span.End()
+
+	err := SendEmailWithAttachment(to, subject, body, "receipt.pdf", attachment)
+	if err != nil {
+		// SMTP errors can quote the recipient, so only the outcome is kept
+		span.SetStatus(codes.Error, "sending receipt email failed")
+	}
+	return err
 }
 
-func SendReceiptEmail(to, subject, body string, attachment []byte) error {
+func SendEmailWithAttachment(to, subject, body, filename string, attachment []byte) error {
 	m := gomail.NewMessage()
-	m.SetHeader("From", "bdauren06@gmail.com")
+	m.SetHeader("From", config.From)
 	m.SetHeader("To", to)
 	m.SetHeader("Subject", subject)
 	m.SetBody("text/html", body)
-	m.Attach("receipt.pdf", gomail.SetCopyFunc(func(w io.Writer) error {
+	m.Attach(filename, gomail.SetCopyFunc(func(w io.Writer) error {
 		_, err := w.Write(attachment)
 		return err
 	}))
 
-	d := gomail.NewDialer("smtp.gmail.com", 587, "bdauren06@gmail.com", "lrhcvmwjvdkbjrkc")
+	d := gomail.NewDialer(config.Host, config.Port, config.Username, config.Password)
 
-	return d.DialAndSend(m)
+	return countSend(d.DialAndSend(m))
 }
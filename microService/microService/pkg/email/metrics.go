@@ -0,0 +1,21 @@
+package email
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var messages = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "email_messages_total",
+	Help: "Emails handed to the SMTP server, by outcome (sent or failed).",
+}, []string{"outcome"})
+
+// countSend records the outcome of a send and passes err through
+func countSend(err error) error {
+	if err != nil {
+		messages.WithLabelValues("failed").Inc()
+	} else {
+		messages.WithLabelValues("sent").Inc()
+	}
+	return err
+}
@@ -0,0 +1,189 @@
+package payment
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Brand is a card network
+type Brand string
+
+const (
+	BrandVisa       Brand = "Visa"
+	BrandMastercard Brand = "Mastercard"
+	BrandAmex       Brand = "American Express"
+	BrandDiscover   Brand = "Discover"
+	BrandUnknown    Brand = "Unknown"
+)
+
+// CardError describes why a card failed validation. Field names match the
+// JSON fields of the payment form.
+type CardError struct {
+	Field   string
+	Message string
+}
+
+func (e *CardError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
+
+// MaskedCard is the only card information that may be logged, stored or
+// printed
+type MaskedCard struct {
+	Brand Brand  `bson:"brand" json:"brand"`
+	Last4 string `bson:"last4" json:"last4"`
+}
+
+func (m MaskedCard) String() string {
+	return fmt.Sprintf("%s ending in %s", m.Brand, m.Last4)
+}
+
+// Normalize strips the spaces and dashes people type into card numbers and
+// expiry dates
+func (c Card) Normalize() Card {
+	c.Number = strings.NewReplacer(" ", "", "-", "").Replace(c.Number)
+	c.ExpirationDate = strings.TrimSpace(c.ExpirationDate)
+	c.CVV = strings.TrimSpace(c.CVV)
+	c.Name = strings.TrimSpace(c.Name)
+	return c
+}
+
+// Masked returns the brand and last four digits of the card
+func (c Card) Masked() MaskedCard {
+	number := c.Normalize().Number
+	last4 := number
+	if len(last4) > 4 {
+		last4 = last4[len(last4)-4:]
+	}
+	return MaskedCard{Brand: DetectBrand(number), Last4: last4}
+}
+
+// String keeps the full number and CVV out of anything that formats a Card
+func (c Card) String() string {
+	return c.Masked().String()
+}
+
+// GoString covers %#v, which would otherwise print every field
+func (c Card) GoString() string {
+	return "payment.Card{" + c.Masked().String() + "}"
+}
+
+// Validate checks a normalized card: the number must pass the Luhn check and
+// belong to a known brand, the expiry must be MM/YY or MM/YYYY and not in
+// the past as of now, and the CVV must have the length the brand uses.
+func (c Card) Validate(now time.Time) error {
+	if c.Number == "" {
+		return &CardError{Field: "cardNumber", Message: "is required"}
+	}
+	if !isDigits(c.Number) || len(c.Number) < 12 || len(c.Number) > 19 {
+		return &CardError{Field: "cardNumber", Message: "must be 12 to 19 digits"}
+	}
+	if !luhnValid(c.Number) {
+		return &CardError{Field: "cardNumber", Message: "is not a valid card number"}
+	}
+	brand := DetectBrand(c.Number)
+	if brand == BrandUnknown {
+		return &CardError{Field: "cardNumber", Message: "card brand is not supported"}
+	}
+
+	expiry, err := parseExpiry(c.ExpirationDate)
+	if err != nil {
+		return &CardError{Field: "expirationDate", Message: "must be MM/YY or MM/YYYY"}
+	}
+	// A card is valid through the last moment of its expiry month
+	if !now.Before(expiry.AddDate(0, 1, 0)) {
+		return &CardError{Field: "expirationDate", Message: "card has expired"}
+	}
+
+	cvvLength := 3
+	if brand == BrandAmex {
+		cvvLength = 4
+	}
+	if len(c.CVV) != cvvLength || !isDigits(c.CVV) {
+		return &CardError{Field: "cvv", Message: fmt.Sprintf("must be %d digits for %s", cvvLength, brand)}
+	}
+
+	if c.Name == "" {
+		return &CardError{Field: "name", Message: "is required"}
+	}
+	return nil
+}
+
+// DetectBrand identifies the card network from the number's prefix
+func DetectBrand(number string) Brand {
+	prefix := func(n int) int {
+		if len(number) < n {
+			return -1
+		}
+		v, err := strconv.Atoi(number[:n])
+		if err != nil {
+			return -1
+		}
+		return v
+	}
+
+	switch {
+	case prefix(1) == 4:
+		return BrandVisa
+	case prefix(2) >= 51 && prefix(2) <= 55, prefix(4) >= 2221 && prefix(4) <= 2720:
+		return BrandMastercard
+	case prefix(2) == 34, prefix(2) == 37:
+		return BrandAmex
+	case prefix(4) == 6011, prefix(2) == 65, prefix(3) >= 644 && prefix(3) <= 649:
+		return BrandDiscover
+	}
+	return BrandUnknown
+}
+
+// parseExpiry returns the first day of the expiry month in UTC
+func parseExpiry(value string) (time.Time, error) {
+	value = strings.ReplaceAll(value, "-", "/")
+	parts := strings.Split(value, "/")
+	if len(parts) != 2 || len(parts[0]) < 1 || len(parts[0]) > 2 {
+		return time.Time{}, fmt.Errorf("invalid expiry %q", value)
+	}
+	month, err := strconv.Atoi(parts[0])
+	if err != nil || month < 1 || month > 12 {
+		return time.Time{}, fmt.Errorf("invalid expiry month %q", parts[0])
+	}
+	year, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid expiry year %q", parts[1])
+	}
+	switch len(parts[1]) {
+	case 2:
+		year += 2000
+	case 4:
+	default:
+		return time.Time{}, fmt.Errorf("invalid expiry year %q", parts[1])
+	}
+	return time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC), nil
+}
+
+func luhnValid(number string) bool {
+	sum := 0
+	double := false
+	for i := len(number) - 1; i >= 0; i-- {
+		d := int(number[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
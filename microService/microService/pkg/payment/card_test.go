@@ -0,0 +1,114 @@
+package payment
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestCardValidate(t *testing.T) {
+	now := time.Date(2026, time.March, 15, 12, 0, 0, 0, time.UTC)
+	valid := Card{Number: "4242424242424242", ExpirationDate: "12/28", CVV: "123", Name: "Ada Lovelace"}
+
+	tests := []struct {
+		name      string
+		card      func(c Card) Card
+		wantField string
+	}{
+		{"valid", func(c Card) Card { return c }, ""},
+		{"four digit year", func(c Card) Card { c.ExpirationDate = "12/2028"; return c }, ""},
+		{"expires this month", func(c Card) Card { c.ExpirationDate = "03/26"; return c }, ""},
+		{"amex with four digit cvv", func(c Card) Card { c.Number = "378282246310005"; c.CVV = "1234"; return c }, ""},
+		{"missing number", func(c Card) Card { c.Number = ""; return c }, "cardNumber"},
+		{"letters in number", func(c Card) Card { c.Number = "4242abcd42424242"; return c }, "cardNumber"},
+		{"too short", func(c Card) Card { c.Number = "42424242"; return c }, "cardNumber"},
+		{"fails luhn", func(c Card) Card { c.Number = "4242424242424241"; return c }, "cardNumber"},
+		{"unknown brand", func(c Card) Card { c.Number = "3530111333300000"; return c }, "cardNumber"},
+		{"bad expiry format", func(c Card) Card { c.ExpirationDate = "2028-12-01"; return c }, "expirationDate"},
+		{"bad expiry month", func(c Card) Card { c.ExpirationDate = "13/28"; return c }, "expirationDate"},
+		{"expired last month", func(c Card) Card { c.ExpirationDate = "02/26"; return c }, "expirationDate"},
+		{"short cvv", func(c Card) Card { c.CVV = "12"; return c }, "cvv"},
+		{"amex with three digit cvv", func(c Card) Card { c.Number = "378282246310005"; return c }, "cvv"},
+		{"missing name", func(c Card) Card { c.Name = ""; return c }, "name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.card(valid).Validate(now)
+			if tt.wantField == "" {
+				if err != nil {
+					t.Fatalf("Validate() error = %v, want nil", err)
+				}
+				return
+			}
+			var cardErr *CardError
+			if !errors.As(err, &cardErr) || cardErr.Field != tt.wantField {
+				t.Fatalf("Validate() error = %v, want a CardError on %s", err, tt.wantField)
+			}
+		})
+	}
+}
+
+func TestCardNormalizeAndMask(t *testing.T) {
+	card := Card{Number: " 4242-4242 4242 4242 ", ExpirationDate: " 12/28 ", CVV: " 123 ", Name: " Ada "}.Normalize()
+	if card.Number != "4242424242424242" || card.ExpirationDate != "12/28" || card.CVV != "123" || card.Name != "Ada" {
+		t.Fatalf("Normalize() = %#v fields not trimmed", card)
+	}
+
+	want := MaskedCard{Brand: BrandVisa, Last4: "4242"}
+	if got := card.Masked(); got != want {
+		t.Errorf("Masked() = %+v, want %+v", got, want)
+	}
+	for _, formatted := range []string{fmt.Sprint(card), fmt.Sprintf("%v", card), fmt.Sprintf("%+v", card), fmt.Sprintf("%#v", card)} {
+		if formatted != "Visa ending in 4242" && formatted != "payment.Card{Visa ending in 4242}" {
+			t.Errorf("formatting a card printed %q", formatted)
+		}
+	}
+}
+
+func TestDetectBrand(t *testing.T) {
+	tests := []struct {
+		number string
+		want   Brand
+	}{
+		{"4242424242424242", BrandVisa},
+		{"5555555555554444", BrandMastercard},
+		{"2223003122003222", BrandMastercard},
+		{"378282246310005", BrandAmex},
+		{"341111111111111", BrandAmex},
+		{"6011111111111117", BrandDiscover},
+		{"6500000000000002", BrandDiscover},
+		{"6445644564456445", BrandDiscover},
+		{"3530111333300000", BrandUnknown},
+		{"2720999999999999", BrandMastercard},
+		{"2721000000000000", BrandUnknown},
+		{"", BrandUnknown},
+		{"x", BrandUnknown},
+	}
+	for _, tt := range tests {
+		if got := DetectBrand(tt.number); got != tt.want {
+			t.Errorf("DetectBrand(%q) = %s, want %s", tt.number, got, tt.want)
+		}
+	}
+}
+
+func TestLuhnValid(t *testing.T) {
+	tests := []struct {
+		number string
+		want   bool
+	}{
+		{"4242424242424242", true},
+		{"378282246310005", true},
+		{"6011111111111117", true},
+		{"79927398713", true},
+		{"0", true},
+		{"4242424242424241", false},
+		{"79927398710", false},
+		{"1", false},
+	}
+	for _, tt := range tests {
+		if got := luhnValid(tt.number); got != tt.want {
+			t.Errorf("luhnValid(%q) = %v, want %v", tt.number, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package payment
+
+import (
+	"context"
+	"errors"
+)
+
+var (
+	ErrDeclined              = errors.New("payment declined")
+	ErrInsufficientFunds     = errors.New("insufficient funds")
+	ErrTimeout               = errors.New("payment gateway timeout")
+	ErrUnknownAuthorization  = errors.New("unknown authorization")
+	ErrInvalidState          = errors.New("authorization is not in a state that allows this operation")
+	ErrRefundExceedsCaptured = errors.New("refund exceeds captured amount")
+)
+
+// Card holds the card details needed to authorize a payment
+type Card struct {
+	Number         string
+	ExpirationDate string
+	CVV            string
+	Name           string
+}
+
+// Authorization is a hold placed on a card for an amount
+type Authorization struct {
+	ID     string
+	Amount float64
+}
+
+// PaymentGateway charges cards. An authorization reserves funds, capture
+// takes them, void releases an uncaptured authorization and refund returns
+// some or all of a captured amount.
+type PaymentGateway interface {
+	Authorize(ctx context.Context, amount float64, card Card) (*Authorization, error)
+	Capture(ctx context.Context, authorizationID string, amount float64) error
+	Void(ctx context.Context, authorizationID string) error
+	Refund(ctx context.Context, authorizationID string, amount float64) error
+}
+
+// IsDecline reports whether err means the card was refused, as opposed to
+// the gateway failing
+func IsDecline(err error) bool {
+	return errors.Is(err, ErrDeclined) || errors.Is(err, ErrInsufficientFunds)
+}
@@ -0,0 +1,131 @@
+package payment
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Magic card numbers understood by the Simulator. Any other number is
+// approved. Authorizing TestCardTimeout blocks until ctx is done, like a
+// processor that never answers.
+const (
+	TestCardApproved          = "4242424242424242"
+	TestCardDeclined          = "4000000000000002"
+	TestCardInsufficientFunds = "4000000000009995"
+	TestCardTimeout           = "4000000000000119"
+)
+
+// amountTolerance absorbs float rounding when comparing amounts, e.g. when
+// several partial refunds add up to the captured amount
+const amountTolerance = 0.005
+
+type simulatedStatus int
+
+const (
+	simulatedAuthorized simulatedStatus = iota
+	simulatedCaptured
+	simulatedVoided
+)
+
+type simulatedAuthorization struct {
+	amount   float64
+	captured float64
+	refunded float64
+	status   simulatedStatus
+}
+
+// Simulator is an in-process PaymentGateway that never contacts a real
+// processor. Its outcome depends only on the card number, so tests can
+// drive every path deterministically.
+type Simulator struct {
+	mu             sync.Mutex
+	nextID         int
+	authorizations map[string]*simulatedAuthorization
+}
+
+// NewSimulator returns a Simulator with no authorizations
+func NewSimulator() *Simulator {
+	return &Simulator{authorizations: make(map[string]*simulatedAuthorization)}
+}
+
+func (s *Simulator) Authorize(ctx context.Context, amount float64, card Card) (*Authorization, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	switch card.Number {
+	case TestCardDeclined:
+		return nil, ErrDeclined
+	case TestCardInsufficientFunds:
+		return nil, ErrInsufficientFunds
+	case TestCardTimeout:
+		<-ctx.Done()
+		return nil, fmt.Errorf("%w: %w", ErrTimeout, ctx.Err())
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	id := fmt.Sprintf("sim_auth_%d", s.nextID)
+	s.authorizations[id] = &simulatedAuthorization{amount: amount}
+	return &Authorization{ID: id, Amount: amount}, nil
+}
+
+func (s *Simulator) Capture(ctx context.Context, authorizationID string, amount float64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	auth, ok := s.authorizations[authorizationID]
+	if !ok {
+		return ErrUnknownAuthorization
+	}
+	if auth.status != simulatedAuthorized || amount > auth.amount+amountTolerance {
+		return ErrInvalidState
+	}
+	auth.captured = amount
+	auth.status = simulatedCaptured
+	return nil
+}
+
+func (s *Simulator) Void(ctx context.Context, authorizationID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	auth, ok := s.authorizations[authorizationID]
+	if !ok {
+		return ErrUnknownAuthorization
+	}
+	if auth.status != simulatedAuthorized {
+		return ErrInvalidState
+	}
+	auth.status = simulatedVoided
+	return nil
+}
+
+func (s *Simulator) Refund(ctx context.Context, authorizationID string, amount float64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	auth, ok := s.authorizations[authorizationID]
+	if !ok {
+		return ErrUnknownAuthorization
+	}
+	if auth.status != simulatedCaptured {
+		return ErrInvalidState
+	}
+	if auth.refunded+amount > auth.captured+amountTolerance {
+		return ErrRefundExceedsCaptured
+	}
+	auth.refunded += amount
+	return nil
+}
@@ -0,0 +1,149 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSimulatorAuthorize(t *testing.T) {
+	tests := []struct {
+		name    string
+		number  string
+		wantErr error
+	}{
+		{"approved", TestCardApproved, nil},
+		{"any other number", "5555555555554444", nil},
+		{"declined", TestCardDeclined, ErrDeclined},
+		{"insufficient funds", TestCardInsufficientFunds, ErrInsufficientFunds},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth, err := NewSimulator().Authorize(context.Background(), 12.5, Card{Number: tt.number})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Authorize() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				if !IsDecline(err) {
+					t.Errorf("IsDecline(%v) = false, want true", err)
+				}
+				return
+			}
+			if auth.ID == "" || auth.Amount != 12.5 {
+				t.Errorf("Authorize() = %+v, want an ID and amount 12.5", auth)
+			}
+		})
+	}
+}
+
+func TestSimulatorTimeoutWaitsForContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := NewSimulator().Authorize(ctx, 10, Card{Number: TestCardTimeout})
+	if !errors.Is(err, ErrTimeout) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Authorize() error = %v, want ErrTimeout and context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("Authorize() returned after %v, before the context was done", elapsed)
+	}
+	if IsDecline(err) {
+		t.Errorf("IsDecline(%v) = true, want false", err)
+	}
+}
+
+func TestSimulatorCancelledContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := NewSimulator().Authorize(ctx, 10, Card{Number: TestCardApproved}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Authorize() error = %v, want context.Canceled", err)
+	}
+}
+
+func TestSimulatorLifecycle(t *testing.T) {
+	ctx := context.Background()
+	authorize := func(t *testing.T, s *Simulator) string {
+		t.Helper()
+		auth, err := s.Authorize(ctx, 30, Card{Number: TestCardApproved})
+		if err != nil {
+			t.Fatalf("Authorize() error = %v", err)
+		}
+		return auth.ID
+	}
+
+	tests := []struct {
+		name string
+		run  func(s *Simulator, id string) error
+		want error
+	}{
+		{"capture", func(s *Simulator, id string) error {
+			return s.Capture(ctx, id, 30)
+		}, nil},
+		{"capture more than authorized", func(s *Simulator, id string) error {
+			return s.Capture(ctx, id, 31)
+		}, ErrInvalidState},
+		{"capture twice", func(s *Simulator, id string) error {
+			if err := s.Capture(ctx, id, 30); err != nil {
+				return err
+			}
+			return s.Capture(ctx, id, 30)
+		}, ErrInvalidState},
+		{"void before capture", func(s *Simulator, id string) error {
+			return s.Void(ctx, id)
+		}, nil},
+		{"capture after void", func(s *Simulator, id string) error {
+			if err := s.Void(ctx, id); err != nil {
+				return err
+			}
+			return s.Capture(ctx, id, 30)
+		}, ErrInvalidState},
+		{"void after capture", func(s *Simulator, id string) error {
+			if err := s.Capture(ctx, id, 30); err != nil {
+				return err
+			}
+			return s.Void(ctx, id)
+		}, ErrInvalidState},
+		{"refund after capture", func(s *Simulator, id string) error {
+			if err := s.Capture(ctx, id, 30); err != nil {
+				return err
+			}
+			return s.Refund(ctx, id, 30)
+		}, nil},
+		{"partial refunds adding up to the capture", func(s *Simulator, id string) error {
+			if err := s.Capture(ctx, id, 30); err != nil {
+				return err
+			}
+			for i := 0; i < 3; i++ {
+				if err := s.Refund(ctx, id, 10); err != nil {
+					return err
+				}
+			}
+			return nil
+		}, nil},
+		{"refund more than captured", func(s *Simulator, id string) error {
+			if err := s.Capture(ctx, id, 30); err != nil {
+				return err
+			}
+			if err := s.Refund(ctx, id, 20); err != nil {
+				return err
+			}
+			return s.Refund(ctx, id, 20)
+		}, ErrRefundExceedsCaptured},
+		{"refund before capture", func(s *Simulator, id string) error {
+			return s.Refund(ctx, id, 10)
+		}, ErrInvalidState},
+		{"unknown authorization", func(s *Simulator, id string) error {
+			return s.Capture(ctx, "sim_auth_unknown", 30)
+		}, ErrUnknownAuthorization},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewSimulator()
+			if err := tt.run(s, authorize(t, s)); !errors.Is(err, tt.want) {
+				t.Fatalf("error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
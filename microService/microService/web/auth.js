@@ -0,0 +1,74 @@
+// Shared by the pages that call the API. Access tokens only last a few
+// minutes; authFetch renews them with the stored refresh token.
+
+function storeTokens(pair) {
+    localStorage.setItem('token', pair.access_token);
+    localStorage.setItem('refreshToken', pair.refresh_token);
+}
+
+function clearTokens() {
+    localStorage.removeItem('token');
+    localStorage.removeItem('refreshToken');
+}
+
+// A refresh token can only be used once, so concurrent calls share one
+// refresh; sending the same token twice would log the user out everywhere
+let refreshing = null;
+
+function refreshTokens() {
+    if (!refreshing) {
+        refreshing = fetch('/token/refresh', {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json'
+            },
+            body: JSON.stringify({refresh_token: localStorage.getItem('refreshToken')})
+        }).then(response => {
+            if (!response.ok) {
+                clearTokens();
+                return false;
+            }
+            return response.json().then(pair => {
+                storeTokens(pair);
+                return true;
+            });
+        }).catch(() => false).finally(() => {
+            refreshing = null;
+        });
+    }
+    return refreshing;
+}
+
+// fetch with the current access token, renewing it and retrying once if it
+// has expired
+function authFetch(url, options) {
+    const send = () => {
+        const request = Object.assign({}, options);
+        request.headers = Object.assign({}, request.headers, {
+            'Authorization': 'Bearer ' + localStorage.getItem('token')
+        });
+        return fetch(url, request);
+    };
+    return send().then(response => {
+        if (response.status !== 401 || !localStorage.getItem('refreshToken')) {
+            return response;
+        }
+        return refreshTokens().then(refreshed => refreshed ? send() : response);
+    });
+}
+
+// Revokes the refresh token, and those it was renewed from, on the server
+function logout() {
+    const refreshToken = localStorage.getItem('refreshToken');
+    clearTokens();
+    if (!refreshToken) {
+        return Promise.resolve();
+    }
+    return fetch('/logout', {
+        method: 'POST',
+        headers: {
+            'Content-Type': 'application/json'
+        },
+        body: JSON.stringify({refresh_token: refreshToken})
+    }).catch(() => {});
+}